@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/internal/deadletter"
+)
+
+func main() {
+	redrive := flag.Bool("redrive", false, "write dead-lettered records back to their original topic instead of listing them")
+	limit := flag.Int("limit", 0, "maximum number of records to handle, 0 for all")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	cfg, err := config.NewDeadLetterCfg()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+
+	if err = deadletter.Run(ctx, cfg, deadletter.Options{Redrive: *redrive, Limit: *limit}); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
+)
+
+// Prints service token signed with AUTH_SIGNING_KEY for operator calls, e.g. claiming legacy accounts
+func main() {
+	ttl := flag.Duration("ttl", 10*time.Minute, "lifetime of the token")
+	flag.Parse()
+
+	cfg, err := config.NewAuthCfg()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	cfg.TokenTTL = *ttl
+
+	signer, err := auth.NewSigner(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	token, err := signer.ServiceToken()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	fmt.Println(token)
+}
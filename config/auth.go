@@ -0,0 +1,24 @@
+package config
+
+import (
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// AuthCfg session tokens settings shared by storage (issues tokens) and server (validates tokens)
+type AuthCfg struct {
+	SigningKey string        `env:"AUTH_SIGNING_KEY" env-required:"true"`
+	TokenTTL   time.Duration `env:"AUTH_TOKEN_TTL" env-default:"24h"`
+	// MaxFailedLogins in a row lock account for LockoutDuration
+	MaxFailedLogins int           `env:"AUTH_MAX_FAILED_LOGINS" env-default:"5"`
+	LockoutDuration time.Duration `env:"AUTH_LOCKOUT_DURATION" env-default:"15m"`
+}
+
+func NewAuthCfg() (AuthCfg, error) {
+	var res AuthCfg
+	if err := cleanenv.ReadEnv(&res); err != nil {
+		return AuthCfg{}, err
+	}
+	return res, nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
@@ -8,8 +10,22 @@ type ClientCfg struct {
 	Host      string `env:"CLIENT_HOST" env-default:"localhost"`
 	Port      string `env:"CLIENT_PORT" env-default:"8080"`
 	Path      string `env:"CHAT_PATH" env-default:"/chat"`
+	Room      string `env:"CHAT_ROOM" env-default:"general"`
+	AuthURL   string `env:"CLIENT_AUTH_URL" env-default:"http://localhost:8000"`
 	Scheme    string `env:"CLIENT_SCHEME" env-default:"ws"`
 	LoggerLVL string `env:"CLIENT_LOGGER_LEVEL" env-default:"info"`
+
+	Heartbeat        HeartbeatCfg  `env-prefix:"CLIENT_"`
+	HandshakeTimeout time.Duration `env:"CLIENT_HANDSHAKE_TIMEOUT" env-default:"10s"`
+	Reconnect        ReconnectCfg
+}
+
+// ReconnectCfg lost connection is redialed up to Attempts times, delay between attempts starts from Backoff and
+// doubles up to MaxBackoff
+type ReconnectCfg struct {
+	Attempts   int           `env:"CLIENT_RECONNECT_ATTEMPTS" env-default:"10"`
+	Backoff    time.Duration `env:"CLIENT_RECONNECT_BACKOFF" env-default:"1s"`
+	MaxBackoff time.Duration `env:"CLIENT_RECONNECT_MAX_BACKOFF" env-default:"30s"`
 }
 
 func NewClientCfg() (ClientCfg, error) {
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// DeadLetterCfg of the command inspecting and re-driving dead-letter topic of storage service
+type DeadLetterCfg struct {
+	Kafka KafkaCfg
+	// GroupID consumer group of the command, record is committed once it's re-driven
+	GroupID string `env:"DLQ_GROUP_ID" env-default:"chat-dead-letter"`
+	// Wait topic is considered drained if no record arrives within it
+	Wait      time.Duration `env:"DLQ_WAIT" env-default:"10s"`
+	LoggerLVL string        `env:"DLQ_LOGGER_LEVEL" env-default:"info"`
+}
+
+func NewDeadLetterCfg() (DeadLetterCfg, error) {
+	var res DeadLetterCfg
+	if err := cleanenv.ReadEnv(&res); err != nil {
+		return DeadLetterCfg{}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// HeartbeatCfg WS keepalive settings shared by server and client, env variables are prefixed by the owner.
+// PingInterval must be less than PongWait
+type HeartbeatCfg struct {
+	PingInterval time.Duration `env:"PING_INTERVAL" env-default:"30s"`
+	PongWait     time.Duration `env:"PONG_WAIT" env-default:"60s"`
+	WriteWait    time.Duration `env:"WRITE_WAIT" env-default:"10s"`
+}
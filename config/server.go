@@ -1,20 +1,106 @@
 package config
 
 import (
+	"time"
+
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type ServerCfg struct {
 	Server    ServerAddr
+	Conn      ConnCfg
+	SendQueue SendQueueCfg
+	Typing    TypingCfg
+	History   HistoryCfg
+	RateLimit RateLimitCfg
+	Fanout    FanoutCfg
+	Outbox    OutboxCfg
+	Presence  PresenceCfg
 	Storage   StorageAddr
 	Redis     RedisAddr
 	Kafka     KafkaCfg
+	Auth      AuthCfg
 	LoggerLVL string `env:"SERVER_LOGGER_LEVEL" env-default:"info"`
 }
 
 type ServerAddr struct {
-	Host string `env:"SRV_HOST" env-default:"localhost"`
-	Port string `env:"SRV_PORT" env-default:"8080"`
+	Host        string `env:"SRV_HOST" env-default:"localhost"`
+	Port        string `env:"SRV_PORT" env-default:"8080"`
+	DefaultRoom string `env:"SRV_DEFAULT_ROOM" env-default:"general"`
+	// AllowedOrigins of WS upgrade requests, "*" allows any. If empty, only same origin requests are accepted
+	AllowedOrigins []string `env:"SRV_ALLOWED_ORIGINS" env-separator:","`
+}
+
+// ConnCfg WS connection lifetime limits. IdleTimeout is max time without any frame from client except pongs
+type ConnCfg struct {
+	Heartbeat        HeartbeatCfg  `env-prefix:"SRV_"`
+	HandshakeTimeout time.Duration `env:"SRV_HANDSHAKE_TIMEOUT" env-default:"10s"`
+	IdleTimeout      time.Duration `env:"SRV_IDLE_TIMEOUT" env-default:"10m"`
+}
+
+// SendQueueCfg outbound queue of each WS connection. OverflowPolicy is either drop_oldest or disconnect
+type SendQueueCfg struct {
+	Size           int    `env:"SRV_SEND_QUEUE_SIZE" env-default:"64"`
+	OverflowPolicy string `env:"SRV_SEND_OVERFLOW_POLICY" env-default:"drop_oldest"`
+}
+
+// TypingCfg typing indicator is fanned out at most once per Throttle while user keeps typing,
+// it's expired if client doesn't refresh it within Timeout
+type TypingCfg struct {
+	Throttle time.Duration `env:"SRV_TYPING_THROTTLE" env-default:"3s"`
+	Timeout  time.Duration `env:"SRV_TYPING_TIMEOUT" env-default:"6s"`
+}
+
+// HistoryCfg PageLimit is max number of messages client may request in single history page,
+// ResumeLimit is max number of missed messages replayed to resumed session
+type HistoryCfg struct {
+	PageLimit   int `env:"SRV_HISTORY_PAGE_LIMIT" env-default:"50"`
+	ResumeLimit int `env:"SRV_RESUME_LIMIT" env-default:"1000"`
+}
+
+// RateLimitCfg token buckets of messages, control frames and new connections per user and per remote IP, kept in Redis
+// to be shared by all server instances. Bucket is refilled by *Rate tokens per second up to *Burst, zero rate disables
+// it. Frames which store or look up messages take message tokens, any other frame (receipts, typing, joins, malformed
+// ones) takes cheaper control token. Frames over the limit are violations: MuteAfter violations within ViolationWindow
+// mute user for MuteDuration, DisconnectAfter violations drop connection. Remote IP is taken from X-Forwarded-For only
+// if request comes from one of TrustedProxies (IPs or CIDRs)
+type RateLimitCfg struct {
+	UserMsgRate     float64       `env:"SRV_RATE_USER_MSG_RATE" env-default:"5"`
+	UserMsgBurst    int           `env:"SRV_RATE_USER_MSG_BURST" env-default:"10"`
+	IPMsgRate       float64       `env:"SRV_RATE_IP_MSG_RATE" env-default:"20"`
+	IPMsgBurst      int           `env:"SRV_RATE_IP_MSG_BURST" env-default:"40"`
+	UserCtlRate     float64       `env:"SRV_RATE_USER_CONTROL_RATE" env-default:"20"`
+	UserCtlBurst    int           `env:"SRV_RATE_USER_CONTROL_BURST" env-default:"40"`
+	IPCtlRate       float64       `env:"SRV_RATE_IP_CONTROL_RATE" env-default:"80"`
+	IPCtlBurst      int           `env:"SRV_RATE_IP_CONTROL_BURST" env-default:"160"`
+	UserConnRate    float64       `env:"SRV_RATE_USER_CONN_RATE" env-default:"0.2"`
+	UserConnBurst   int           `env:"SRV_RATE_USER_CONN_BURST" env-default:"5"`
+	IPConnRate      float64       `env:"SRV_RATE_IP_CONN_RATE" env-default:"1"`
+	IPConnBurst     int           `env:"SRV_RATE_IP_CONN_BURST" env-default:"20"`
+	ViolationWindow time.Duration `env:"SRV_RATE_VIOLATION_WINDOW" env-default:"1m"`
+	MuteAfter       int           `env:"SRV_RATE_MUTE_AFTER" env-default:"3"`
+	MuteDuration    time.Duration `env:"SRV_RATE_MUTE_DURATION" env-default:"30s"`
+	DisconnectAfter int           `env:"SRV_RATE_DISCONNECT_AFTER" env-default:"6"`
+	TrustedProxies  []string      `env:"SRV_TRUSTED_PROXIES" env-separator:","`
+}
+
+// PresenceCfg connections of server instance are dropped from presence if it doesn't renew its lease within Lease
+type PresenceCfg struct {
+	Lease time.Duration `env:"SRV_PRESENCE_LEASE" env-default:"30s"`
+}
+
+// FanoutCfg Redis Pub/Sub channels shared by server instances. Room messages are published to MessageChannel by
+// cache along with assigning their sequence numbers, other broadcasts to Channel
+type FanoutCfg struct {
+	Channel        string `env:"SRV_FANOUT_CHANNEL" env-default:"fanout:broadcast"`
+	MessageChannel string `env:"SRV_FANOUT_MESSAGE_CHANNEL" env-default:"fanout:messages"`
+}
+
+// OutboxCfg Redis stream events are written to before they are passed to Kafka. Single instance holding the lease
+// relays them in the order they were written, the lease expires if the instance doesn't renew it within Lease
+type OutboxCfg struct {
+	Stream string        `env:"SRV_OUTBOX_STREAM" env-default:"outbox"`
+	Lease  time.Duration `env:"SRV_OUTBOX_LEASE" env-default:"10s"`
 }
 
 type RedisAddr struct {
@@ -22,6 +108,11 @@ type RedisAddr struct {
 	Port       string `env:"REDIS_PORT" env-default:"6379"`
 	MaxRecords int64  `env:"REDIS_MAX_RECORDS" env-default:"1000"`
 	HeadSize   int64  `env:"REDIS_HEAD_SIZE" env-default:"10"`
+	// ReactionsTTL how long reaction counts of message are kept since its last reaction
+	ReactionsTTL time.Duration `env:"REDIS_REACTIONS_TTL" env-default:"720h"`
+	// IdempotencyTTL how long idempotency key of sent message is remembered, resending message with the same key
+	// within it doesn't duplicate the message
+	IdempotencyTTL time.Duration `env:"REDIS_IDEMPOTENCY_TTL" env-default:"24h"`
 }
 
 func NewServerCfg() (ServerCfg, error) {
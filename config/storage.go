@@ -1,12 +1,29 @@
 package config
 
-import "github.com/ilyakaznacheev/cleanenv"
+import (
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
 
 type StorageConfig struct {
 	HTTP      StorageAddr
 	Repo      RepoCfg
 	Kafka     KafkaCfg
+	Retry     RetryCfg
+	Auth      AuthCfg
 	LoggerLVL string `env:"STORAGE_LOGGER_LEVEL" env-default:"info"`
+
+	// DrainTimeout how long room state request waits for events already in Kafka to be applied
+	DrainTimeout time.Duration `env:"STORAGE_DRAIN_TIMEOUT" env-default:"3s"`
+}
+
+// RetryCfg event failed by unavailable database is retried until it's applied, event failed otherwise (e.g. referring
+// to missing row) is applied up to Attempts times. Delay between attempts starts from Backoff and doubles up to MaxBackoff
+type RetryCfg struct {
+	Attempts   int           `env:"STORAGE_RETRY_ATTEMPTS" env-default:"5"`
+	Backoff    time.Duration `env:"STORAGE_RETRY_BACKOFF" env-default:"200ms"`
+	MaxBackoff time.Duration `env:"STORAGE_RETRY_MAX_BACKOFF" env-default:"10s"`
 }
 
 type RepoCfg struct {
@@ -24,8 +41,10 @@ type KafkaCfg struct {
 	Partition int    `env:"KAFKA_PARTITION" env-default:"0"`
 	Addr      string `env:"KAFKA_ADDR" env-default:"localhost:9092"`
 	GroupID   string `env:"KAFKA_GROUP_ID" env-default:"chat"`
-	BatchSize int    `env:"KAFKA_BATCH_SIZE" env-default:"10"`
-	Async     bool   `env:"KAFKA_ASYNC" env-default:"true"`
+	// BatchSize max number of outbox events relayed to Kafka in single write
+	BatchSize int `env:"KAFKA_BATCH_SIZE" env-default:"10"`
+	// DeadLetterTopic keeps events storage service failed to apply, they are re-driven by deadletter command
+	DeadLetterTopic string `env:"KAFKA_DEAD_LETTER_TOPIC" env-default:"chat-dead-letter"`
 }
 
 type StorageAddr struct {
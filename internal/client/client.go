@@ -2,12 +2,15 @@ package client
 
 import (
 	"context"
+	"errors"
 	"os/signal"
 	"syscall"
 
+	"github.com/rs/zerolog"
 	"github.com/vlasashk/websocket-chat/config"
 	"github.com/vlasashk/websocket-chat/internal/client/models"
 	"github.com/vlasashk/websocket-chat/pkg/logger"
+	"github.com/vlasashk/websocket-chat/pkg/response"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -20,24 +23,40 @@ func Run(ctx context.Context, cfg config.ClientCfg) error {
 		return err
 	}
 
-	user, err := models.NewUser(cfg)
+	user, err := models.NewUser(ctx, cfg)
 	if err != nil {
 		return err
 	}
 	defer user.Close(log)
 
+	input := user.Typer(log)
+	for {
+		err = serve(ctx, log, user, input)
+		if ctx.Err() != nil || errors.Is(err, models.ErrConsoleClosed) {
+			return err
+		}
+		log.Debug().Err(err).Msg("connection lost")
+		// session resumes after the last message shown, missed messages are replayed by server
+		if err = user.Reconnect(ctx, log); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// serve runs session over current connection of the user until the connection is lost
+func serve(ctx context.Context, log zerolog.Logger, user *models.User, input <-chan response.Envelope) error {
 	g, gCtx := errgroup.WithContext(ctx)
 	g.Go(func() error {
 		return user.Receiver(gCtx, log)
 	})
 	g.Go(func() error {
-		return user.Sender(gCtx, log)
+		return user.Sender(gCtx, log, input)
 	})
-
-	err = g.Wait()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	g.Go(func() error {
+		return user.KeepAlive(gCtx, log)
+	})
+	return g.Wait()
 }
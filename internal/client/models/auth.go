@@ -0,0 +1,116 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+	"golang.org/x/term"
+)
+
+// authenticate runs interactive login/register flow until session token is obtained
+func authenticate(ctx context.Context, reader *bufio.Reader, authURL string) (string, response.LoginResp, error) {
+	for {
+		fmt.Print("[l]ogin or [r]egister: ")
+		choice, err := reader.ReadString('\n')
+		if err != nil {
+			return "", response.LoginResp{}, err
+		}
+		choice = strings.ToLower(strings.TrimSpace(choice))
+		if choice != "l" && choice != "r" {
+			fmt.Println("ERROR: type l or r. Try again")
+			continue
+		}
+
+		username, err := setUsername(reader)
+		if err != nil {
+			return "", response.LoginResp{}, err
+		}
+		password, err := readPassword(reader, "Password: ")
+		if err != nil {
+			return "", response.LoginResp{}, err
+		}
+
+		if choice == "r" {
+			repeated, err := readPassword(reader, "Repeat password: ")
+			if err != nil {
+				return "", response.LoginResp{}, err
+			}
+			if repeated != password {
+				fmt.Println("ERROR: passwords don't match. Try again")
+				continue
+			}
+
+			if err = postJSON(ctx, authURL+"/register", http.StatusCreated, response.RegisterReq{Username: username, Password: password}, &response.RegisterResp{}); err != nil {
+				fmt.Println("ERROR:", err)
+				continue
+			}
+		}
+
+		var session response.LoginResp
+		if err = postJSON(ctx, authURL+"/login", http.StatusOK, response.LoginReq{Username: username, Password: password}, &session); err != nil {
+			fmt.Println("ERROR:", err)
+			continue
+		}
+
+		return username, session, nil
+	}
+}
+
+// readPassword reads password without echo when stdin is terminal
+func readPassword(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		return string(password), nil
+	}
+
+	password, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(password, "\n"), nil
+}
+
+// postJSON sends request to storage service decoding response into v on expected status or ErrResp otherwise
+func postJSON(ctx context.Context, reqURL string, status int, body, v any) error {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		var errResp response.ErrResp
+		if err = render.DecodeJSON(resp.Body, &errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("request failed with status %d", resp.StatusCode)
+		}
+		return fmt.Errorf("request failed: %s", errResp.Error)
+	}
+
+	return render.DecodeJSON(resp.Body, v)
+}
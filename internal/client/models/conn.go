@@ -0,0 +1,72 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/vlasashk/websocket-chat/pkg/listener"
+)
+
+var errTokenRejected = errors.New("server rejected session token")
+
+// dial opens WS connection to the room. Reconnected session resumes after the last message seen in the room,
+// so server replays messages missed meanwhile
+func (u *User) dial(ctx context.Context, room string, lastSeq int64) (*websocket.Conn, error) {
+	query := url.Values{"room": {room}}
+	if lastSeq > 0 {
+		query.Set("last_seq", strconv.FormatInt(lastSeq, 10))
+	}
+	chatURL := u.chatURL
+	chatURL.RawQuery = query.Encode()
+
+	header := http.Header{"Authorization": {"Bearer " + u.token}}
+	con, resp, err := u.dialer.DialContext(ctx, chatURL.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, errTokenRejected
+		}
+		return nil, err
+	}
+	if err = listener.ExpectPongs(con, u.Heartbeat); err != nil {
+		_ = con.Close()
+		return nil, err
+	}
+	return con, nil
+}
+
+// Reconnect replaces lost connection with the new one of the same session, attempts are delayed by exponential backoff
+func (u *User) Reconnect(ctx context.Context, log zerolog.Logger) error {
+	u.Close(log)
+
+	delay := u.reconnect.Backoff
+	var err error
+	for attempt := 1; attempt <= u.reconnect.Attempts; attempt++ {
+		fmt.Printf("*** connection lost, reconnecting in %s (%d/%d)\n", delay, attempt, u.reconnect.Attempts)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		var con *websocket.Conn
+		con, err = u.dial(ctx, u.room, u.lastSeq)
+		if err == nil {
+			fmt.Printf("*** reconnected to %s\n", u.room)
+			u.Con = con
+			return nil
+		}
+		if errors.Is(err, errTokenRejected) {
+			return err
+		}
+		log.Error().Err(err).Int("attempt", attempt).Msg("failed to reconnect")
+		delay = min(2*delay, u.reconnect.MaxBackoff)
+	}
+	return fmt.Errorf("failed to reconnect: %w", err)
+}
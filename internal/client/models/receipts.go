@@ -0,0 +1,31 @@
+package models
+
+import (
+	"sync"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// readMarker holds latest message of other users shown in console until sender reports it as delivered or read.
+// Message IDs are time ordered, so only the newest one is kept
+type readMarker struct {
+	mu      sync.Mutex
+	pending string
+}
+
+func (m *readMarker) set(msg response.Msg) {
+	m.mu.Lock()
+	if msg.ID > m.pending {
+		m.pending = msg.ID
+	}
+	m.mu.Unlock()
+}
+
+// take returns pending message ID and clears it, empty ID means nothing new was read
+func (m *readMarker) take() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.pending
+	m.pending = ""
+	return id
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"sync"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// refBook maps short message references shown in console to full message IDs. It also remembers the oldest
+// message of current room shown, so history can be scrolled back from it
+type refBook struct {
+	mu     sync.Mutex
+	ids    map[string]string
+	oldest string
+}
+
+func newRefBook() *refBook {
+	return &refBook{ids: make(map[string]string)}
+}
+
+func (b *refBook) add(msg response.Msg) {
+	if msg.ID == "" {
+		return
+	}
+	b.mu.Lock()
+	b.ids[msg.Ref()] = msg.ID
+	b.mu.Unlock()
+}
+
+// resolve returns message ID by its reference, unknown reference is considered to be full message ID
+func (b *refBook) resolve(ref string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id, ok := b.ids[ref]; ok {
+		return id
+	}
+	return ref
+}
+
+// scrolled records the first message of history batch, reset clears the oldest message of previous room
+func (b *refBook) scrolled(messages []response.Msg, reset bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if reset {
+		b.oldest = ""
+	}
+	if len(messages) > 0 && (b.oldest == "" || messages[0].ID < b.oldest) {
+		b.oldest = messages[0].ID
+	}
+}
+
+func (b *refBook) oldestID() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.oldest
+}
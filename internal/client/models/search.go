@@ -0,0 +1,32 @@
+package models
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// lastSearch remembers query of the latest search results and offset of their next page
+type lastSearch struct {
+	mu         sync.Mutex
+	query      string
+	nextOffset int
+}
+
+func (l *lastSearch) set(payload response.SearchPayload) {
+	l.mu.Lock()
+	l.query = payload.Query
+	l.nextOffset = payload.NextOffset
+	l.mu.Unlock()
+}
+
+// next builds request for the next page of the latest search
+func (l *lastSearch) next() (response.SearchRequest, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.query == "" || l.nextOffset == 0 {
+		return response.SearchRequest{}, errors.New("usage: /search <terms>, /search alone shows more results of the last search")
+	}
+	return response.SearchRequest{Query: l.query, Offset: l.nextOffset}, nil
+}
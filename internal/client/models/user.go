@@ -7,51 +7,91 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/vlasashk/websocket-chat/config"
 	"github.com/vlasashk/websocket-chat/pkg/listener"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
+// receiptInterval how often messages shown in console are reported as delivered
+const receiptInterval = time.Second
+
+// ErrConsoleClosed console input is over, session can't go on
+var ErrConsoleClosed = errors.New("console reader is dead")
+
 type User struct {
-	Username string
-	Reader   *bufio.Reader
-	Con      *websocket.Conn
+	Username  string
+	Reader    *bufio.Reader
+	Con       *websocket.Conn
+	Heartbeat config.HeartbeatCfg
+	refs      *refBook
+	delivered *readMarker
+	reads     *readMarker
+	search    *lastSearch
+	// token, dialer and chatURL open connections of the session
+	token     string
+	dialer    websocket.Dialer
+	chatURL   url.URL
+	reconnect config.ReconnectCfg
+	// userID, typing, own, room and lastSeq are accessed by receiver only (and reconnect after receiver is stopped)
+	userID int
+	// typing users by ID
+	typing map[int]bool
+	// own IDs of messages sent by the user, their read receipts are shown
+	own map[string]bool
+	// room current room, lastSeq sequence number of the latest message shown in it
+	room    string
+	lastSeq int64
+	// unsent message which failed to be written to lost connection, it's resent over the new one with the same
+	// idempotency key, so server stores it once even if it has received it
+	unsent *response.Envelope
 }
 
-func NewUser(cfg config.ClientCfg) (*User, error) {
+func NewUser(ctx context.Context, cfg config.ClientCfg) (*User, error) {
 	reader := bufio.NewReader(os.Stdin)
-	urlDial := url.URL{Scheme: cfg.Scheme, Host: net.JoinHostPort(cfg.Host, cfg.Port), Path: cfg.Path}
 
-	username, err := setUsername(reader)
+	username, session, err := authenticate(ctx, reader, cfg.AuthURL)
 	if err != nil {
 		return nil, err
 	}
 
-	con, _, err := websocket.DefaultDialer.Dial(urlDial.String(), nil)
-	if err != nil {
-		return nil, err
+	u := &User{
+		Reader:    reader,
+		Username:  username,
+		Heartbeat: cfg.Heartbeat,
+		refs:      newRefBook(),
+		delivered: &readMarker{},
+		reads:     &readMarker{},
+		search:    &lastSearch{},
+		token:     session.Token,
+		dialer: websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: cfg.HandshakeTimeout,
+		},
+		chatURL: url.URL{
+			Scheme: cfg.Scheme,
+			Host:   net.JoinHostPort(cfg.Host, cfg.Port),
+			Path:   cfg.Path,
+		},
+		reconnect: cfg.Reconnect,
+		typing:    make(map[int]bool),
+		own:       make(map[string]bool),
+		room:      cfg.Room,
 	}
-
-	if err = con.WriteMessage(websocket.TextMessage, []byte(username)); err != nil {
-		if err := con.Close(); err != nil {
-			log.Error().Err(err).Send()
-		}
+	if u.Con, err = u.dial(ctx, u.room, 0); err != nil {
 		return nil, err
 	}
-
-	return &User{
-		Reader:   reader,
-		Username: username,
-		Con:      con,
-	}, nil
+	return u, nil
 }
 
 func (u *User) Receiver(ctx context.Context, log zerolog.Logger) error {
@@ -64,67 +104,417 @@ func (u *User) Receiver(ctx context.Context, log zerolog.Logger) error {
 			if !ok {
 				return errors.New("connection died unexpectedly")
 			}
-			var msg response.Msg
-			if err := json.Unmarshal(data, &msg); err != nil {
-				log.Error().Err(err).Msg("failed to unmarshal msg")
+			var env response.Envelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				log.Error().Err(err).Msg("failed to unmarshal envelope")
 				continue
 			}
-			msg.Print()
+			if err := u.printEnvelope(log, env); err != nil {
+				log.Error().Err(err).Str("type", string(env.Type)).Msg("failed to decode payload")
+			}
 		}
 	}
 }
 
-func (u *User) Sender(ctx context.Context, log zerolog.Logger) error {
-	input := u.typer(log)
+// Sender writes console input and receipts to current connection, starting with message left unsent by the
+// previous one. Shown messages are reported as delivered once a second and as read when user types next line,
+// since it means user is looking at the console
+func (u *User) Sender(ctx context.Context, log zerolog.Logger, input <-chan response.Envelope) error {
+	receipts := time.NewTicker(receiptInterval)
+	defer receipts.Stop()
+	if u.unsent != nil {
+		if err := u.write(log, *u.unsent); err != nil {
+			return err
+		}
+		u.unsent = nil
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case msg, ok := <-input:
 			if !ok {
-				return errors.New("console reader is dead")
+				return ErrConsoleClosed
 			}
-			if err := u.Con.WriteJSON(msg); err != nil {
-				log.Error().Err(err).Send()
+			if err := u.receipt(log, u.reads, response.ReceiptRead); err != nil {
+				return err
+			}
+			if err := u.write(log, msg); err != nil {
+				if msg.Type == response.TypeMessage || msg.Type == response.TypeDirect {
+					u.unsent = &msg
+				}
+				return err
+			}
+		case <-receipts.C:
+			if err := u.receipt(log, u.delivered, response.ReceiptDelivered); err != nil {
 				return err
 			}
 		}
 	}
 }
 
+// receipt reports message pending in the marker, if there is one
+func (u *User) receipt(log zerolog.Logger, marker *readMarker, kind string) error {
+	messageID := marker.take()
+	if messageID == "" {
+		return nil
+	}
+	env, err := response.NewEnvelope(response.TypeReceipt, "", response.ReceiptPayload{
+		MessageID: messageID,
+		Kind:      kind,
+	})
+	if err != nil {
+		return err
+	}
+	return u.write(log, env)
+}
+
+// write sends frame to server, sender is the only goroutine writing data frames
+func (u *User) write(log zerolog.Logger, env response.Envelope) error {
+	if err := u.Con.SetWriteDeadline(time.Now().Add(u.Heartbeat.WriteWait)); err != nil {
+		return err
+	}
+	if err := u.Con.WriteJSON(env); err != nil {
+		log.Error().Err(err).Send()
+		return err
+	}
+	return nil
+}
+
+// KeepAlive pings server and drops connection when server stops answering
+func (u *User) KeepAlive(ctx context.Context, log zerolog.Logger) error {
+	return listener.Heartbeat(ctx, log, u.Con, u.Heartbeat)
+}
+
 func (u *User) Close(log zerolog.Logger) {
 	if err := u.Con.Close(); err != nil {
 		log.Error().Err(err).Send()
 	}
 }
 
-// typer runs separately exposing chanel to be able to gracefully shut down, since reading from console is blocking
-func (u *User) typer(log zerolog.Logger) <-chan response.Msg {
-	messages := make(chan response.Msg)
+// Typer runs separately exposing chanel to be able to gracefully shut down, since reading from console is blocking.
+// It outlives connections, so input typed while reconnecting is sent over the new one
+func (u *User) Typer(log zerolog.Logger) <-chan response.Envelope {
+	messages := make(chan response.Envelope)
 	go func() {
-		var err error
+		var seq int
 		for {
-			var msg response.Msg
-			msg.Username = u.Username
-
-			msg.Text, err = u.Reader.ReadString('\n')
+			line, err := u.Reader.ReadString('\n')
 			if err != nil {
 				log.Error().Msg(fmt.Sprintln("read:", err))
 				close(messages)
 				return
 			}
 
-			msg.Text = strings.TrimSuffix(msg.Text, "\n")
-			if utf8.RuneCountInString(msg.Text) == 0 {
+			line = strings.TrimSuffix(line, "\n")
+			if utf8.RuneCountInString(line) == 0 {
 				continue
 			}
 
-			messages <- msg
+			seq++
+			env, err := u.parseInput(strconv.Itoa(seq), line)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				continue
+			}
+
+			messages <- env
 		}
 	}()
 	return messages
 }
 
+// parseInput converts console line into envelope, recognizing client commands
+func (u *User) parseInput(id, line string) (response.Envelope, error) {
+	if room, ok := strings.CutPrefix(line, "/join "); ok {
+		return response.NewEnvelope(response.TypeJoin, id, response.JoinPayload{Room: strings.TrimSpace(room)})
+	}
+	if line == "/who" {
+		return response.NewEnvelope(response.TypeRoster, id, nil)
+	}
+	if args, ok := strings.CutPrefix(line, "/msg "); ok {
+		return parseDirect(id, args)
+	}
+	if args, ok := strings.CutPrefix(line, "/edit "); ok {
+		return u.parseEdit(id, args)
+	}
+	if args, ok := strings.CutPrefix(line, "/react "); ok {
+		return u.parseReaction(id, args, false)
+	}
+	if args, ok := strings.CutPrefix(line, "/unreact "); ok {
+		return u.parseReaction(id, args, true)
+	}
+	if ref, ok := strings.CutPrefix(line, "/delete "); ok {
+		return response.NewEnvelope(response.TypeDelete, id, response.DeletePayload{MessageID: u.refs.resolve(strings.TrimSpace(ref))})
+	}
+	if line == "/history" || strings.HasPrefix(line, "/history ") {
+		return u.parseHistory(id, strings.TrimPrefix(line, "/history"))
+	}
+	if line == "/search" || strings.HasPrefix(line, "/search ") {
+		return u.parseSearch(id, strings.TrimSpace(strings.TrimPrefix(line, "/search")))
+	}
+	if ref, ok := strings.CutPrefix(line, "/seen "); ok {
+		return response.NewEnvelope(response.TypeReadBy, id, response.ReadByPayload{MessageID: u.refs.resolve(strings.TrimSpace(ref))})
+	}
+	return response.NewEnvelope(response.TypeMessage, id, response.Msg{Text: line, IdempotencyKey: uuid.NewString()})
+}
+
+// parseDirect builds private message from "<user> <text>" arguments, user is either username or #<user ID>
+func parseDirect(id, args string) (response.Envelope, error) {
+	to, text, ok := strings.Cut(strings.TrimSpace(args), " ")
+	text = strings.TrimSpace(text)
+	if !ok || text == "" {
+		return response.Envelope{}, errors.New("usage: /msg <username or #id> <text>")
+	}
+
+	msg := response.Msg{Recipient: to, Text: text, IdempotencyKey: uuid.NewString()}
+	if rawID, ok := strings.CutPrefix(to, "#"); ok {
+		userID, err := strconv.Atoi(rawID)
+		if err != nil || userID <= 0 {
+			return response.Envelope{}, fmt.Errorf("invalid user ID: %q", rawID)
+		}
+		msg.Recipient = ""
+		msg.RecipientID = userID
+	}
+	return response.NewEnvelope(response.TypeDirect, id, msg)
+}
+
+// parseEdit builds edit request from "<ref> <text>" arguments, ref is either short reference shown next to message or full message ID
+func (u *User) parseEdit(id, args string) (response.Envelope, error) {
+	ref, text, ok := strings.Cut(strings.TrimSpace(args), " ")
+	text = strings.TrimSpace(text)
+	if !ok || text == "" {
+		return response.Envelope{}, errors.New("usage: /edit <message ref> <text>")
+	}
+	return response.NewEnvelope(response.TypeEdit, id, response.EditPayload{MessageID: u.refs.resolve(ref), Text: text})
+}
+
+// parseHistory builds request for earlier messages from "[ref] [limit]" arguments. Without ref history is
+// scrolled back from the oldest message shown
+func (u *User) parseHistory(id, args string) (response.Envelope, error) {
+	req := response.HistoryRequest{Before: u.refs.oldestID()}
+	fields := strings.Fields(args)
+	if len(fields) > 2 {
+		return response.Envelope{}, errors.New("usage: /history [message ref] [limit]")
+	}
+	if len(fields) > 0 {
+		req.Before = u.refs.resolve(fields[0])
+	}
+	if len(fields) == 2 {
+		limit, err := strconv.Atoi(fields[1])
+		if err != nil || limit <= 0 {
+			return response.Envelope{}, fmt.Errorf("invalid limit: %q", fields[1])
+		}
+		req.Limit = limit
+	}
+	return response.NewEnvelope(response.TypeHistory, id, req)
+}
+
+// parseSearch builds search request, without terms it asks for more results of the last search
+func (u *User) parseSearch(id, terms string) (response.Envelope, error) {
+	if terms == "" {
+		req, err := u.search.next()
+		if err != nil {
+			return response.Envelope{}, err
+		}
+		return response.NewEnvelope(response.TypeSearch, id, req)
+	}
+	return response.NewEnvelope(response.TypeSearch, id, response.SearchRequest{Query: terms})
+}
+
+// parseReaction builds reaction request from "<ref> <emoji>" arguments
+func (u *User) parseReaction(id, args string, remove bool) (response.Envelope, error) {
+	ref, emoji, ok := strings.Cut(strings.TrimSpace(args), " ")
+	emoji = strings.TrimSpace(emoji)
+	if !ok || emoji == "" {
+		return response.Envelope{}, errors.New("usage: /react <message ref> <emoji>, /unreact <message ref> <emoji>")
+	}
+	return response.NewEnvelope(response.TypeReaction, id, response.ReactionPayload{
+		MessageID: u.refs.resolve(ref),
+		Emoji:     emoji,
+		Remove:    remove,
+	})
+}
+
+// printEnvelope outputs received frame to console depending on its type
+func (u *User) printEnvelope(log zerolog.Logger, env response.Envelope) error {
+	switch env.Type {
+	case response.TypeHello:
+		var hello response.HelloPayload
+		if err := env.Decode(&hello); err != nil {
+			return err
+		}
+		u.userID = hello.UserID
+		fmt.Printf("*** logged in as %s\n", hello.Username)
+	case response.TypeMessage, response.TypeDirect, response.TypeEdit:
+		var msg response.Msg
+		if err := env.Decode(&msg); err != nil {
+			return err
+		}
+		u.show(msg)
+	case response.TypeHistory:
+		var history response.HistoryPayload
+		if err := env.Decode(&history); err != nil {
+			return err
+		}
+		u.refs.scrolled(history.Messages, env.ID == "" && !history.Resumed)
+		if history.Resumed {
+			// replay of messages missed while reconnecting
+			if history.Truncated {
+				fmt.Println("--- some of missed messages are skipped, use /history to see them ---")
+			}
+			for _, msg := range history.Messages {
+				u.show(msg)
+			}
+			return nil
+		}
+		if env.ID != "" {
+			// answer to /history
+			if len(history.Messages) == 0 {
+				fmt.Printf("--- no earlier messages in %s ---\n", history.Room)
+				return nil
+			}
+			fmt.Printf("--- earlier messages in %s ---\n", history.Room)
+			for _, msg := range history.Messages {
+				u.show(msg)
+			}
+			return nil
+		}
+		// markers of previous room must not be reported in the new one
+		u.delivered.take()
+		u.reads.take()
+		u.room = history.Room
+		u.lastSeq = 0
+		if history.Unread > 0 {
+			fmt.Printf("--- joined room %s (%d unread) ---\n", history.Room, history.Unread)
+		} else {
+			fmt.Printf("--- joined room %s ---\n", history.Room)
+		}
+		for _, msg := range history.Messages {
+			u.show(msg)
+		}
+	case response.TypeDelete:
+		var del response.DeletePayload
+		if err := env.Decode(&del); err != nil {
+			return err
+		}
+		fmt.Printf("*** message #%s was deleted\n", response.Msg{ID: del.MessageID}.Ref())
+	case response.TypeReaction:
+		var reaction response.ReactionPayload
+		if err := env.Decode(&reaction); err != nil {
+			return err
+		}
+		action := "reacted"
+		if reaction.Remove {
+			action = "withdrew"
+		}
+		fmt.Printf("*** %s %s %s to #%s (%d)\n", reaction.Username, action, reaction.Emoji,
+			response.Msg{ID: reaction.MessageID}.Ref(), reaction.Count)
+	case response.TypeReceipt:
+		var receipt response.ReceiptPayload
+		if err := env.Decode(&receipt); err != nil {
+			return err
+		}
+		if receipt.Kind == response.ReceiptRead && receipt.UserID != u.userID && u.own[receipt.MessageID] {
+			fmt.Printf("*** %s has read #%s\n", receipt.Username, response.Msg{ID: receipt.MessageID}.Ref())
+		}
+	case response.TypeReadBy:
+		var readBy response.ReadByPayload
+		if err := env.Decode(&readBy); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(readBy.Users))
+		for _, user := range readBy.Users {
+			names = append(names, user.Username)
+		}
+		fmt.Printf("*** #%s seen by: %s\n", response.Msg{ID: readBy.MessageID}.Ref(), strings.Join(names, ", "))
+	case response.TypeSearch:
+		var search response.SearchPayload
+		if err := env.Decode(&search); err != nil {
+			return err
+		}
+		u.search.set(search)
+		fmt.Printf("--- search results for %q ---\n", search.Query)
+		for _, hit := range search.Results {
+			u.refs.add(hit.Msg)
+			msg := hit.Msg
+			msg.Text = hit.Highlight
+			fmt.Print(msg.SentAt.Local().Format(time.DateOnly), " ")
+			msg.Print()
+		}
+		if search.NextOffset > 0 {
+			fmt.Println("--- /search for more ---")
+		} else if len(search.Results) == 0 {
+			fmt.Println("--- nothing found ---")
+		}
+	case response.TypeTyping:
+		var typing response.TypingPayload
+		if err := env.Decode(&typing); err != nil {
+			return err
+		}
+		// server refreshes indicator while user keeps typing, only changes are shown
+		if u.typing[typing.UserID] == typing.Typing {
+			return nil
+		}
+		u.typing[typing.UserID] = typing.Typing
+		if typing.Typing {
+			fmt.Printf("*** %s is typing in %s...\n", typing.Username, typing.Room)
+		} else {
+			fmt.Printf("*** %s stopped typing in %s\n", typing.Username, typing.Room)
+		}
+	case response.TypePresence:
+		var presence response.PresencePayload
+		if err := env.Decode(&presence); err != nil {
+			return err
+		}
+		fmt.Printf("*** %s %s %s\n", presence.Username, presence.Action, presence.Room)
+	case response.TypeRoster:
+		var roster response.RosterPayload
+		if err := env.Decode(&roster); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(roster.Users))
+		for _, user := range roster.Users {
+			names = append(names, user.Username)
+		}
+		fmt.Printf("*** online in %s: %s\n", roster.Room, strings.Join(names, ", "))
+	case response.TypeError:
+		var errResp response.ErrorPayload
+		if err := env.Decode(&errResp); err != nil {
+			return err
+		}
+		fmt.Printf("ERROR: %s (%s)\n", errResp.Message, errResp.Code)
+	case response.TypeSystem:
+		var sys response.SystemPayload
+		if err := env.Decode(&sys); err != nil {
+			return err
+		}
+		fmt.Printf("*** %s\n", sys.Text)
+	case response.TypeAck:
+		log.Debug().Str("id", env.ID).Msg("ack received")
+	default:
+		log.Debug().Str("type", string(env.Type)).Msg("unsupported envelope type")
+	}
+	return nil
+}
+
+// show prints message remembering its reference. Room messages of other users are marked to be reported as
+// delivered and read
+func (u *User) show(msg response.Msg) {
+	u.refs.add(msg)
+	msg.Print()
+	if msg.Room == u.room && msg.Seq > u.lastSeq {
+		u.lastSeq = msg.Seq
+	}
+	switch {
+	case msg.UserID == u.userID:
+		u.own[msg.ID] = true
+	case msg.Room != "":
+		u.delivered.set(msg)
+		u.reads.set(msg)
+	}
+}
+
 func setUsername(reader *bufio.Reader) (string, error) {
 	var username string
 	var err error
@@ -0,0 +1,132 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/pkg/kakafka"
+	"github.com/vlasashk/websocket-chat/pkg/logger"
+)
+
+// Options of single run: records are either listed or re-driven, Limit caps their number unless it's zero
+type Options struct {
+	Redrive bool
+	Limit   int
+}
+
+// Run reads dead-letter topic until it's drained or record dead-lettered after the start is reached (e.g. re-driven
+// record which failed again). Listed records stay in the topic, re-driven ones are written back to their original
+// topic (storage service applies them again) and committed
+func Run(ctx context.Context, cfg config.DeadLetterCfg, opts Options) error {
+	started := time.Now().UTC()
+
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	log, err := logger.New(cfg.LoggerLVL)
+	if err != nil {
+		return err
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{cfg.Kafka.Addr},
+		GroupID: cfg.GroupID,
+		Topic:   cfg.Kafka.DeadLetterTopic,
+	})
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close dead-letter reader")
+		}
+	}()
+
+	// re-driven record is committed only once it's acknowledged by original topic
+	writer := kakafka.NewSyncWriter(cfg.Kafka.Addr, "")
+	defer func() {
+		if err := writer.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close writer")
+		}
+	}()
+
+	var handled int
+	for opts.Limit == 0 || handled < opts.Limit {
+		fetchCtx, cancelFetch := context.WithTimeout(ctx, cfg.Wait)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancelFetch()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		if failedAt, err := time.Parse(time.RFC3339Nano, kakafka.Header(msg, kakafka.HeaderFailedAt)); err == nil && failedAt.After(started) {
+			break
+		}
+
+		show(msg)
+		if opts.Redrive {
+			if err = redrive(ctx, log, writer, cfg.Kafka.Topic, msg); err != nil {
+				return err
+			}
+			if err = reader.CommitMessages(ctx, msg); err != nil {
+				return err
+			}
+		}
+		handled++
+	}
+
+	action := "listed"
+	if opts.Redrive {
+		action = "re-driven"
+	}
+	fmt.Printf("%d records %s\n", handled, action)
+	return nil
+}
+
+// redrive writes record to the topic it was dead-lettered from (default topic if it's unknown) without failure headers
+func redrive(ctx context.Context, log zerolog.Logger, writer *kafka.Writer, defaultTopic string, msg kafka.Message) error {
+	topic := kakafka.Header(msg, kakafka.HeaderTopic)
+	if topic == "" {
+		topic = defaultTopic
+	}
+
+	headers := make([]kafka.Header, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		if !strings.HasPrefix(h.Key, kakafka.HeaderPrefix) {
+			headers = append(headers, h)
+		}
+	}
+	if err := writer.WriteMessages(ctx, kafka.Message{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}); err != nil {
+		return err
+	}
+	log.Debug().Str("topic", topic).Int64("offset", msg.Offset).Msg("record is re-driven")
+	return nil
+}
+
+// show prints record with its failure
+func show(msg kafka.Message) {
+	fmt.Printf("offset %d: %s/%s/%s key=%q kind=%s attempts=%s failed_at=%s\n  error: %s\n  value: %s\n",
+		msg.Offset,
+		kakafka.Header(msg, kakafka.HeaderTopic),
+		kakafka.Header(msg, kakafka.HeaderPartition),
+		kakafka.Header(msg, kakafka.HeaderOffset),
+		msg.Key,
+		kakafka.Header(msg, kakafka.HeaderErrorKind),
+		kakafka.Header(msg, kakafka.HeaderAttempts),
+		kakafka.Header(msg, kakafka.HeaderFailedAt),
+		kakafka.Header(msg, kakafka.HeaderError),
+		msg.Value,
+	)
+}
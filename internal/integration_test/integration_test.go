@@ -1,27 +1,40 @@
 package integration_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/internal/deadletter"
 	"github.com/vlasashk/websocket-chat/internal/server"
 	"github.com/vlasashk/websocket-chat/internal/storage"
 	"github.com/vlasashk/websocket-chat/internal/storage/adapters/pgrepo"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
 	"github.com/vlasashk/websocket-chat/migrations"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
+	"github.com/vlasashk/websocket-chat/pkg/kakafka"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
@@ -32,6 +45,23 @@ const (
 	healthzPath   = "/healthz"
 	dbPass        = "postgres"
 	migrationPath = "../../migrations"
+	authKey       = "integration-test-signing-key-0123456789"
+	password      = "correct horse battery"
+	newPassword   = "tr0ub4dor&3 staple"
+	maxFailed     = 3
+	// legacyUserID account created before passwords were introduced
+	legacyUserID = 999998
+	// maxRecords keeps room cache short, so older history pages are read from storage
+	maxRecords = 11
+	msgBurst   = 30
+	ctlBurst   = 60
+	connBurst  = 10
+	// httpServPeer second server instance sharing Redis, Kafka and storage with the first one
+	httpServPeer = "localhost:8081"
+	// retryAttempts of storage service for record referring to missing row
+	retryAttempts = 3
+	// deadLetterUserID author unknown to storage until dead-lettered record is re-driven
+	deadLetterUserID = 999999
 )
 
 var testPool *pgxpool.Pool
@@ -39,6 +69,27 @@ var testPool *pgxpool.Pool
 func TestMain(t *testing.M) {
 	os.Setenv("DB_PASSWORD", dbPass)
 	os.Setenv("DB_MIGRATION_PATH", migrationPath)
+	os.Setenv("AUTH_SIGNING_KEY", authKey)
+	os.Setenv("AUTH_MAX_FAILED_LOGINS", strconv.Itoa(maxFailed))
+	os.Setenv("SRV_TYPING_THROTTLE", "200ms")
+	os.Setenv("SRV_TYPING_TIMEOUT", "500ms")
+	os.Setenv("REDIS_MAX_RECORDS", strconv.Itoa(maxRecords))
+	os.Setenv("STORAGE_RETRY_ATTEMPTS", strconv.Itoa(retryAttempts))
+	os.Setenv("STORAGE_RETRY_BACKOFF", "50ms")
+	os.Setenv("STORAGE_RETRY_MAX_BACKOFF", "200ms")
+	// all test clients share the same IP and send bursts of messages
+	os.Setenv("SRV_RATE_USER_MSG_RATE", "20")
+	os.Setenv("SRV_RATE_USER_MSG_BURST", strconv.Itoa(msgBurst))
+	os.Setenv("SRV_RATE_IP_MSG_RATE", "100")
+	os.Setenv("SRV_RATE_IP_MSG_BURST", "200")
+	os.Setenv("SRV_RATE_USER_CONTROL_RATE", "40")
+	os.Setenv("SRV_RATE_USER_CONTROL_BURST", strconv.Itoa(ctlBurst))
+	os.Setenv("SRV_RATE_IP_CONTROL_RATE", "200")
+	os.Setenv("SRV_RATE_IP_CONTROL_BURST", "400")
+	os.Setenv("SRV_RATE_USER_CONN_RATE", "1")
+	os.Setenv("SRV_RATE_USER_CONN_BURST", strconv.Itoa(connBurst))
+	os.Setenv("SRV_RATE_IP_CONN_RATE", "50")
+	os.Setenv("SRV_RATE_IP_CONN_BURST", "100")
 
 	go func() {
 		cfg, err := config.NewStorageCfg()
@@ -60,8 +111,19 @@ func TestMain(t *testing.M) {
 		log.Fatal().Err(err).Send()
 	}
 
-	if err := healthcheck("http://" + httpServ + healthzPath); err != nil {
-		log.Fatal().Err(err).Send()
+	go func() {
+		cfg, err := config.NewServerCfg()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not load server config")
+		}
+		_, cfg.Server.Port, _ = net.SplitHostPort(httpServPeer)
+		log.Error().Err(server.Run(context.Background(), cfg)).Send()
+	}()
+
+	for _, host := range []string{httpServ, httpServPeer} {
+		if err := healthcheck("http://" + host + healthzPath); err != nil {
+			log.Fatal().Err(err).Send()
+		}
 	}
 
 	tearDown, err := setupDB()
@@ -80,36 +142,67 @@ func TestMain(t *testing.M) {
 
 func TestServer(t *testing.T) {
 	t.Run("NicknameRegister", func(t *testing.T) {
-		urlDial := url.URL{Scheme: "ws", Host: httpServ, Path: chatPath}
-		con, _, err := websocket.DefaultDialer.Dial(urlDial.String(), nil)
-		require.NoError(t, err)
+		con := connect(t, "first_test", 1)
 		defer func() {
 			assert.NoError(t, con.Close())
 		}()
 
-		registerTest(t, con, "first_test", 1)
-
 		closeMsg := websocket.FormatCloseMessage(websocket.CloseMessage, "close connection")
 
-		err = con.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(2*time.Second))
+		err := con.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(2*time.Second))
 		assert.NoError(t, err)
 		// wait server to close con
 		time.Sleep(100 * time.Millisecond)
 	})
-	t.Run("SendFiveMessages", func(t *testing.T) {
+	t.Run("Unauthorized", func(t *testing.T) {
 		urlDial := url.URL{Scheme: "ws", Host: httpServ, Path: chatPath}
-		con, _, err := websocket.DefaultDialer.Dial(urlDial.String(), nil)
-		require.NoError(t, err)
+		_, resp, err := websocket.DefaultDialer.Dial(urlDial.String(), nil)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		urlDial.RawQuery = url.Values{"token": {"forged.token.value"}}.Encode()
+		_, resp, err = websocket.DefaultDialer.Dial(urlDial.String(), nil)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+	t.Run("SendFiveMessages", func(t *testing.T) {
+		con := connect(t, "second_test", 2)
 		defer func() {
 			assert.NoError(t, con.Close())
 		}()
-
-		registerTest(t, con, "second_test", 2)
 		go testReceive(t, con, 5)
 
-		err = sendMsg(con, 5)
+		err := sendMsg(con, 5)
 		assert.NoError(t, err)
 
+		// metrics are served only to internal services
+		getJSON(t, "http://"+httpServ+"/debug/vars", "", http.StatusUnauthorized, &response.ErrResp{})
+		getJSON(t, "http://"+httpServ+"/debug/vars", login(t, "second_test", password).Token, http.StatusUnauthorized,
+			&response.ErrResp{})
+		service := serviceToken(t)
+		// the last frame may still be handled by server
+		assert.Eventually(t, func() bool {
+			var vars struct {
+				SpoofAttempts map[string]int `json:"spoof_attempts"`
+			}
+			req, err := http.NewRequest(http.MethodGet, "http://"+httpServ+"/debug/vars", nil)
+			if err != nil {
+				return false
+			}
+			req.Header.Set("Authorization", "Bearer "+service)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+			if err = json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+				return false
+			}
+			return vars.SpoofAttempts["user_id"] == 5 && vars.SpoofAttempts["username"] == 5
+		}, 2*time.Second, 50*time.Millisecond)
+
 		closeMsg := websocket.FormatCloseMessage(websocket.CloseMessage, "close connection")
 		// wait before sending close
 		time.Sleep(200 * time.Millisecond)
@@ -120,36 +213,1399 @@ func TestServer(t *testing.T) {
 		time.Sleep(100 * time.Millisecond)
 	})
 	t.Run("GetLastFive", func(t *testing.T) {
-		urlDial := url.URL{Scheme: "ws", Host: httpServ, Path: chatPath}
-		con, _, err := websocket.DefaultDialer.Dial(urlDial.String(), nil)
-		require.NoError(t, err)
+		con := connect(t, "third_test", 3)
 		defer func() {
 			assert.NoError(t, con.Close())
 		}()
 
-		registerTest(t, con, "third_test", 3)
-
 		testReceive(t, con, 5)
 
 		closeMsg := websocket.FormatCloseMessage(websocket.CloseMessage, "close connection")
 		// wait before sending close
 		time.Sleep(200 * time.Millisecond)
 
-		err = con.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(2*time.Second))
+		err := con.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(2*time.Second))
 		assert.NoError(t, err)
 		// wait server to close con
 		time.Sleep(100 * time.Millisecond)
 	})
+	t.Run("MalformedFrame", func(t *testing.T) {
+		con := connect(t, "fourth_test", 4)
+		defer func() {
+			assert.NoError(t, con.Close())
+		}()
+		// skip hello and recent history
+		for i := 0; i < 2; i++ {
+			_, _, err := con.ReadMessage()
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, con.WriteMessage(websocket.TextMessage, []byte("not an envelope")))
+		var env response.Envelope
+		require.NoError(t, con.ReadJSON(&env))
+		assert.Equal(t, response.TypeError, env.Type)
+
+		var errResp response.ErrorPayload
+		require.NoError(t, env.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeBadRequest, errResp.Code)
+
+		require.NoError(t, con.WriteJSON(response.Envelope{Version: response.ProtocolVersion, Type: "unknown", ID: "1"}))
+		require.NoError(t, con.ReadJSON(&env))
+		assert.Equal(t, response.TypeError, env.Type)
+		assert.Equal(t, "1", env.ID)
+		require.NoError(t, env.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeUnsupportedType, errResp.Code)
+
+		long, err := response.NewEnvelope(response.TypeMessage, "long", response.Msg{Text: strings.Repeat("a", 4001)})
+		require.NoError(t, err)
+		require.NoError(t, con.WriteJSON(long))
+		env = readType(t, con, response.TypeError)
+		assert.Equal(t, "long", env.ID)
+		require.NoError(t, env.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeBadRequest, errResp.Code)
+
+		// frame over read limit closes connection
+		require.NoError(t, con.WriteMessage(websocket.TextMessage, make([]byte, 128<<10)))
+		for {
+			if _, _, err = con.ReadMessage(); err != nil {
+				break
+			}
+		}
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig))
+	})
+	t.Run("PersistentAccount", func(t *testing.T) {
+		// case and unicode width variations resolve to the existing account
+		for _, username := range []string{"first_test", "FIRST_TEST", "ｆｉｒｓｔ_ｔｅｓｔ"} {
+			assert.Equal(t, 1, login(t, username, password).UserID)
+		}
+
+		var count int
+		err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM users`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, count)
+
+		token := login(t, "first_test", password).Token
+		var user response.User
+		getJSON(t, "http://"+httpStorage+"/users/1", token, http.StatusOK, &user)
+		assert.Equal(t, "first_test", user.Username)
+
+		getJSON(t, "http://"+httpStorage+"/users?username=Second_Test", token, http.StatusOK, &user)
+		assert.Equal(t, 2, user.UserID)
+
+		getJSON(t, "http://"+httpStorage+"/users/100", token, http.StatusNotFound, &response.ErrResp{})
+		getJSON(t, "http://"+httpStorage+"/users/1", "", http.StatusUnauthorized, &response.ErrResp{})
+	})
+	t.Run("PasswordAccount", func(t *testing.T) {
+		// username is taken regardless of case
+		postJSON(t, "/register", response.RegisterReq{Username: "Second_Test", Password: password}, http.StatusConflict, &response.ErrResp{})
+		postJSON(t, "/register", response.RegisterReq{Username: "fifth_test", Password: "short"}, http.StatusBadRequest, &response.ErrResp{})
+		postJSON(t, "/login", response.LoginReq{Username: "missing_test", Password: password}, http.StatusUnauthorized, &response.ErrResp{})
+
+		stale := login(t, "third_test", password).Token
+		postJSON(t, "/password", response.ChangePasswordReq{Username: "third_test", Password: password, NewPassword: newPassword}, http.StatusNoContent, nil)
+		postJSON(t, "/login", response.LoginReq{Username: "third_test", Password: password}, http.StatusUnauthorized, &response.ErrResp{})
+		fresh := login(t, "third_test", newPassword)
+		assert.Equal(t, 3, fresh.UserID)
+
+		// tokens issued before password change are revoked
+		getJSON(t, "http://"+httpStorage+"/users/3", stale, http.StatusUnauthorized, &response.ErrResp{})
+		getJSON(t, "http://"+httpStorage+"/users/3", fresh.Token, http.StatusOK, &response.User{})
+		_, resp, err := websocket.DefaultDialer.Dial((&url.URL{Scheme: "ws", Host: httpServ, Path: chatPath}).String(),
+			http.Header{"Authorization": {"Bearer " + stale}})
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.NoError(t, dial(t, fresh.Token).Close())
+
+		// failed attempts lock account, even correct password is rejected until lockout expires
+		for i := 1; i < maxFailed; i++ {
+			postJSON(t, "/login", response.LoginReq{Username: "fourth_test", Password: "wrong password"}, http.StatusUnauthorized, &response.ErrResp{})
+		}
+		postJSON(t, "/login", response.LoginReq{Username: "fourth_test", Password: "wrong password"}, http.StatusLocked, &response.ErrResp{})
+		postJSON(t, "/login", response.LoginReq{Username: "fourth_test", Password: password}, http.StatusLocked, &response.ErrResp{})
+
+		var hash string
+		err = testPool.QueryRow(context.Background(), `SELECT password_hash FROM users WHERE user_id = 1`).Scan(&hash)
+		require.NoError(t, err)
+		assert.NotContains(t, hash, password)
+	})
+	t.Run("LegacyAccount", func(t *testing.T) {
+		// account created before passwords were introduced, it's removed so user IDs of later tests are kept
+		_, err := testPool.Exec(context.Background(),
+			`INSERT INTO users (user_id, username, username_key) VALUES ($1, 'legacy_test', 'legacy_test')`, legacyUserID)
+		require.NoError(t, err)
+		defer func() {
+			_, err := testPool.Exec(context.Background(), `DELETE FROM users WHERE user_id = $1`, legacyUserID)
+			assert.NoError(t, err)
+		}()
+
+		// registration doesn't take over the account, it can't log in until claimed by service
+		postJSON(t, "/register", response.RegisterReq{Username: "legacy_test", Password: password}, http.StatusConflict, &response.ErrResp{})
+		postJSON(t, "/login", response.LoginReq{Username: "legacy_test", Password: password}, http.StatusUnauthorized, &response.ErrResp{})
+
+		service := serviceToken(t)
+		claim := func(token string, status int) {
+			data, err := json.Marshal(response.ClaimReq{Password: password})
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPut, "http://"+httpStorage+"/users/"+strconv.Itoa(legacyUserID)+"/password",
+				bytes.NewReader(data))
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode)
+		}
+
+		claim(login(t, "first_test", password).Token, http.StatusForbidden)
+		claim(service, http.StatusNoContent)
+		assert.Equal(t, legacyUserID, login(t, "legacy_test", password).UserID)
+		// claimed account is like any other, password is changed only given the current one
+		claim(service, http.StatusConflict)
+	})
+	t.Run("DirectMessage", func(t *testing.T) {
+		sender := connect(t, "fifth_test", 5)
+		recipient := dial(t, login(t, "second_test", password).Token)
+		bystander := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{sender, recipient, bystander} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		env, err := response.NewEnvelope(response.TypeDirect, "dm", response.Msg{Recipient: "Second_Test", Text: "psst"})
+		require.NoError(t, err)
+		require.NoError(t, sender.WriteJSON(env))
+		for _, con := range []*websocket.Conn{sender, recipient} {
+			var msg response.Msg
+			require.NoError(t, readType(t, con, response.TypeDirect).Decode(&msg))
+			assert.Equal(t, 5, msg.UserID)
+			assert.Equal(t, 2, msg.RecipientID)
+			assert.Equal(t, "second_test", msg.Recipient)
+			assert.Empty(t, msg.Room)
+			assert.Equal(t, "psst", msg.Text)
+		}
+
+		env, err = response.NewEnvelope(response.TypeDirect, "missing", response.Msg{RecipientID: 100, Text: "psst"})
+		require.NoError(t, err)
+		require.NoError(t, sender.WriteJSON(env))
+		errEnv := readType(t, sender, response.TypeError)
+		assert.Equal(t, "missing", errEnv.ID)
+		var errResp response.ErrorPayload
+		require.NoError(t, errEnv.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeNotFound, errResp.Code)
+
+		// direct message is neither delivered to other users nor cached in room history
+		var history response.HistoryPayload
+		require.NoError(t, readType(t, bystander, response.TypeHistory).Decode(&history))
+		for _, msg := range history.Messages {
+			assert.Zero(t, msg.RecipientID)
+		}
+		require.NoError(t, bystander.SetReadDeadline(time.Now().Add(300*time.Millisecond)))
+		_, _, err = bystander.ReadMessage()
+		assert.Error(t, err)
+
+		assert.Eventually(t, func() bool {
+			var count int
+			err := testPool.QueryRow(context.Background(),
+				`SELECT count(*) FROM messages WHERE user_id = 5 AND recipient_id = 2 AND room IS NULL`).Scan(&count)
+			return err == nil && count == 1
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+	t.Run("EditMessage", func(t *testing.T) {
+		author := dial(t, login(t, "second_test", password).Token)
+		observer := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{author, observer} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		var history response.HistoryPayload
+		require.NoError(t, readType(t, author, response.TypeHistory).Decode(&history))
+		require.NotEmpty(t, history.Messages)
+		target := history.Messages[0]
+
+		edit := func(con *websocket.Conn, id, messageID, text string) {
+			env, err := response.NewEnvelope(response.TypeEdit, id, response.EditPayload{MessageID: messageID, Text: text})
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+		}
+		expectErr := func(con *websocket.Conn, id, code string) {
+			errEnv := readType(t, con, response.TypeError)
+			assert.Equal(t, id, errEnv.ID)
+			var errResp response.ErrorPayload
+			require.NoError(t, errEnv.Decode(&errResp))
+			assert.Equal(t, code, errResp.Code)
+		}
+
+		edit(author, "edit", target.ID, "edited")
+		assert.Equal(t, "edit", readType(t, author, response.TypeAck).ID)
+		for _, con := range []*websocket.Conn{author, observer} {
+			var msg response.Msg
+			require.NoError(t, readType(t, con, response.TypeEdit).Decode(&msg))
+			assert.Equal(t, target.ID, msg.ID)
+			assert.Equal(t, "edited", msg.Text)
+			assert.Equal(t, 2, msg.UserID)
+			assert.NotNil(t, msg.EditedAt)
+		}
+
+		edit(observer, "foreign", target.ID, "hijacked")
+		expectErr(observer, "foreign", response.ErrCodeForbidden)
+		edit(author, "unknown", uuid.NewString(), "edited")
+		expectErr(author, "unknown", response.ErrCodeNotFound)
+
+		// cached copy is updated
+		fresh := dial(t, login(t, "third_test", newPassword).Token)
+		defer func() {
+			assert.NoError(t, fresh.Close())
+		}()
+		require.NoError(t, readType(t, fresh, response.TypeHistory).Decode(&history))
+		require.NotEmpty(t, history.Messages)
+		assert.Equal(t, "edited", history.Messages[0].Text)
+
+		// direct message isn't cached, so it's edited via storage service
+		var dmID string
+		err := testPool.QueryRow(context.Background(), `SELECT message_id::text FROM messages WHERE recipient_id = 2`).Scan(&dmID)
+		require.NoError(t, err)
+		dmAuthor := dial(t, login(t, "fifth_test", password).Token)
+		defer func() {
+			assert.NoError(t, dmAuthor.Close())
+		}()
+		edit(dmAuthor, "dm", dmID, "psst, edited")
+		for _, con := range []*websocket.Conn{dmAuthor, author} {
+			var msg response.Msg
+			require.NoError(t, readType(t, con, response.TypeEdit).Decode(&msg))
+			assert.Equal(t, dmID, msg.ID)
+			assert.Equal(t, 2, msg.RecipientID)
+			assert.Equal(t, "psst, edited", msg.Text)
+		}
+
+		assert.Eventually(t, func() bool {
+			var count int
+			err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM message_edits e
+				JOIN messages m ON m.message_id = e.message_id
+				WHERE (m.message_id = $1 AND e.content = 'test_0' AND m.content = 'edited')
+				   OR (m.message_id = $2 AND e.content = 'psst' AND m.content = 'psst, edited')`, target.ID, dmID).Scan(&count)
+			return err == nil && count == 2
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+	t.Run("DeleteMessage", func(t *testing.T) {
+		author := dial(t, login(t, "second_test", password).Token)
+		observer := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{author, observer} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		var history response.HistoryPayload
+		require.NoError(t, readType(t, author, response.TypeHistory).Decode(&history))
+		require.Len(t, history.Messages, 5)
+		own, foreign := history.Messages[1], history.Messages[2]
+
+		remove := func(con *websocket.Conn, id, messageID string) {
+			env, err := response.NewEnvelope(response.TypeDelete, id, response.DeletePayload{MessageID: messageID})
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+		}
+		expectDeleted := func(messageID string, deletedBy int, cons ...*websocket.Conn) {
+			for _, con := range cons {
+				var del response.DeletePayload
+				require.NoError(t, readType(t, con, response.TypeDelete).Decode(&del))
+				assert.Equal(t, messageID, del.MessageID)
+				assert.Equal(t, deletedBy, del.DeletedBy)
+			}
+		}
+
+		remove(author, "own", own.ID)
+		assert.Equal(t, "own", readType(t, author, response.TypeAck).ID)
+		expectDeleted(own.ID, 2, author, observer)
+
+		remove(observer, "foreign", foreign.ID)
+		errEnv := readType(t, observer, response.TypeError)
+		assert.Equal(t, "foreign", errEnv.ID)
+		var errResp response.ErrorPayload
+		require.NoError(t, errEnv.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeForbidden, errResp.Code)
+
+		// moderator role is checked on each takedown, token issued before it was granted is enough
+		_, err := testPool.Exec(context.Background(), `UPDATE users SET is_moderator = true WHERE user_id = 1`)
+		require.NoError(t, err)
+		remove(observer, "takedown", foreign.ID)
+		assert.Equal(t, "takedown", readType(t, observer, response.TypeAck).ID)
+		expectDeleted(foreign.ID, 1, author, observer)
+
+		// revoked role takes effect before the token expires
+		_, err = testPool.Exec(context.Background(), `UPDATE users SET is_moderator = false WHERE user_id = 1`)
+		require.NoError(t, err)
+		remove(observer, "revoked", history.Messages[3].ID)
+		errEnv = readType(t, observer, response.TypeError)
+		assert.Equal(t, "revoked", errEnv.ID)
+		require.NoError(t, errEnv.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeForbidden, errResp.Code)
+
+		fresh := dial(t, login(t, "third_test", newPassword).Token)
+		defer func() {
+			assert.NoError(t, fresh.Close())
+		}()
+		require.NoError(t, readType(t, fresh, response.TypeHistory).Decode(&history))
+		require.Len(t, history.Messages, 3)
+		for _, msg := range history.Messages {
+			assert.NotContains(t, []string{own.ID, foreign.ID}, msg.ID)
+		}
+
+		assert.Eventually(t, func() bool {
+			var count int
+			err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM messages
+				WHERE deleted_at IS NOT NULL AND ((message_id = $1 AND deleted_by = 2) OR (message_id = $2 AND deleted_by = 1))`,
+				own.ID, foreign.ID).Scan(&count)
+			return err == nil && count == 2
+		}, 5*time.Second, 100*time.Millisecond)
+		getJSON(t, "http://"+httpStorage+"/messages/"+own.ID, login(t, "second_test", password).Token, http.StatusNotFound, &response.ErrResp{})
+	})
+	t.Run("Reactions", func(t *testing.T) {
+		second := dial(t, login(t, "second_test", password).Token)
+		first := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{second, first} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		var history response.HistoryPayload
+		require.NoError(t, readType(t, second, response.TypeHistory).Decode(&history))
+		require.Len(t, history.Messages, 3)
+		target := history.Messages[1]
+
+		react := func(con *websocket.Conn, id, messageID string, remove bool) {
+			env, err := response.NewEnvelope(response.TypeReaction, id, response.ReactionPayload{
+				MessageID: messageID,
+				Emoji:     "👍",
+				Remove:    remove,
+			})
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+		}
+		expectCount := func(userID, count int, remove bool) {
+			for _, con := range []*websocket.Conn{second, first} {
+				var reaction response.ReactionPayload
+				require.NoError(t, readType(t, con, response.TypeReaction).Decode(&reaction))
+				assert.Equal(t, target.ID, reaction.MessageID)
+				assert.Equal(t, "👍", reaction.Emoji)
+				assert.Equal(t, userID, reaction.UserID)
+				assert.Equal(t, remove, reaction.Remove)
+				assert.Equal(t, count, reaction.Count)
+			}
+		}
+
+		react(second, "1", target.ID, false)
+		expectCount(2, 1, false)
+		react(first, "2", target.ID, false)
+		expectCount(1, 2, false)
+		react(first, "3", target.ID, true)
+		expectCount(1, 1, true)
+
+		// direct message of other users is not visible
+		var dmID string
+		err := testPool.QueryRow(context.Background(), `SELECT message_id::text FROM messages WHERE recipient_id = 2`).Scan(&dmID)
+		require.NoError(t, err)
+		react(first, "dm", dmID, false)
+		errEnv := readType(t, first, response.TypeError)
+		assert.Equal(t, "dm", errEnv.ID)
+		var errResp response.ErrorPayload
+		require.NoError(t, errEnv.Decode(&errResp))
+		assert.Equal(t, response.ErrCodeNotFound, errResp.Code)
+
+		fresh := dial(t, login(t, "third_test", newPassword).Token)
+		defer func() {
+			assert.NoError(t, fresh.Close())
+		}()
+		require.NoError(t, readType(t, fresh, response.TypeHistory).Decode(&history))
+		require.Len(t, history.Messages, 3)
+		assert.Equal(t, map[string]int{"👍": 1}, history.Messages[1].Reactions)
+		assert.Empty(t, history.Messages[0].Reactions)
+
+		assert.Eventually(t, func() bool {
+			var userID int
+			err := testPool.QueryRow(context.Background(),
+				`SELECT user_id FROM message_reactions WHERE message_id = $1 AND emoji = '👍'`, target.ID).Scan(&userID)
+			return err == nil && userID == 2
+		}, 5*time.Second, 100*time.Millisecond)
+
+		// storage keeps counts of reactions which are no longer cached, cache is seeded from it on the next reaction
+		var stored []response.Msg
+		getJSON(t, "http://"+httpStorage+"/rooms/"+target.Room+"/messages?limit=3", login(t, "first_test", password).Token,
+			http.StatusOK, &stored)
+		require.Len(t, stored, 3)
+		assert.Equal(t, map[string]int{"👍": 1}, stored[1].Reactions)
+
+		cfg, err := config.NewServerCfg()
+		require.NoError(t, err)
+		cache := redis.NewClient(&redis.Options{Addr: net.JoinHostPort(cfg.Redis.Host, cfg.Redis.Port)})
+		defer func() {
+			assert.NoError(t, cache.Close())
+		}()
+		require.NoError(t, cache.Del(context.Background(), "reactions:"+target.ID, "reactors:"+target.ID).Err())
+		react(first, "4", target.ID, false)
+		expectCount(1, 2, false)
+	})
+	t.Run("Typing", func(t *testing.T) {
+		typist := dial(t, login(t, "second_test", password).Token)
+		watcher := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{typist, watcher} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		typing := func(state bool) {
+			env, err := response.NewEnvelope(response.TypeTyping, "", response.TypingPayload{Typing: state})
+			require.NoError(t, err)
+			require.NoError(t, typist.WriteJSON(env))
+		}
+		expectTyping := func(state bool) {
+			var payload response.TypingPayload
+			require.NoError(t, readType(t, watcher, response.TypeTyping).Decode(&payload))
+			assert.Equal(t, state, payload.Typing)
+			assert.Equal(t, 2, payload.UserID)
+			assert.Equal(t, "general", payload.Room)
+		}
+
+		// repeated signal within throttle interval isn't fanned out, indicator expires without refresh
+		typing(true)
+		typing(true)
+		expectTyping(true)
+		expectTyping(false)
+
+		// sent message stops typing
+		typing(true)
+		expectTyping(true)
+		env, err := response.NewEnvelope(response.TypeMessage, "msg", response.Msg{Text: "typed"})
+		require.NoError(t, err)
+		require.NoError(t, typist.WriteJSON(env))
+		expectTyping(false)
+
+		// typist doesn't see own indicator
+		require.NoError(t, typist.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			var frame response.Envelope
+			if err = typist.ReadJSON(&frame); err != nil {
+				break
+			}
+			assert.NotEqual(t, response.TypeTyping, frame.Type)
+		}
+	})
+	t.Run("Presence", func(t *testing.T) {
+		// wait server to release connections of previous tests
+		time.Sleep(200 * time.Millisecond)
+		watcher := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			assert.NoError(t, watcher.Close())
+		}()
+		token := login(t, "second_test", password).Token
+		// connections of the user are served by different instances, presence is shared between them
+		tabs := []*websocket.Conn{dial(t, token), dialHost(t, httpServPeer, token)}
+
+		expectPresence := func(action string) {
+			var presence response.PresencePayload
+			require.NoError(t, readType(t, watcher, response.TypePresence).Decode(&presence))
+			assert.Equal(t, action, presence.Action)
+			assert.Equal(t, 2, presence.UserID)
+			assert.Equal(t, "general", presence.Room)
+		}
+		roster := func() []string {
+			env, err := response.NewEnvelope(response.TypeRoster, "who", nil)
+			require.NoError(t, err)
+			require.NoError(t, watcher.WriteJSON(env))
+			require.NoError(t, watcher.SetReadDeadline(time.Now().Add(5*time.Second)))
+			for {
+				var frame response.Envelope
+				require.NoError(t, watcher.ReadJSON(&frame))
+				// user with several connections is present once
+				require.NotEqual(t, response.TypePresence, frame.Type)
+				if frame.Type != response.TypeRoster {
+					continue
+				}
+				var payload response.RosterPayload
+				require.NoError(t, frame.Decode(&payload))
+				names := make([]string, 0, len(payload.Users))
+				for _, user := range payload.Users {
+					names = append(names, user.Username)
+				}
+				return names
+			}
+		}
+
+		expectPresence(response.PresenceJoined)
+		assert.Equal(t, []string{"first_test", "second_test"}, roster())
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+httpServ+"/online", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var online []response.OnlineUser
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&online))
+		require.Len(t, online, 2)
+		assert.Equal(t, response.OnlineUser{UserID: 2, Username: "second_test", Rooms: []string{"general"}, Connections: 2}, online[1])
+		getJSON(t, "http://"+httpServ+"/online", "", http.StatusUnauthorized, &response.ErrResp{})
+
+		require.NoError(t, tabs[0].Close())
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, []string{"first_test", "second_test"}, roster())
+
+		require.NoError(t, tabs[1].Close())
+		expectPresence(response.PresenceLeft)
+		assert.Equal(t, []string{"first_test"}, roster())
+	})
+	t.Run("ReadReceipts", func(t *testing.T) {
+		author := dial(t, login(t, "second_test", password).Token)
+		readerToken := login(t, "first_test", password).Token
+		reader := dial(t, readerToken)
+		defer func() {
+			assert.NoError(t, author.Close())
+		}()
+
+		say := func(text string) response.Msg {
+			env, err := response.NewEnvelope(response.TypeMessage, "say", response.Msg{Text: text})
+			require.NoError(t, err)
+			require.NoError(t, author.WriteJSON(env))
+			var msg response.Msg
+			require.NoError(t, readType(t, reader, response.TypeMessage).Decode(&msg))
+			require.Equal(t, text, msg.Text)
+			return msg
+		}
+		stored := func(messageID string) {
+			require.Eventually(t, func() bool {
+				var count int
+				err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM messages WHERE message_id = $1`, messageID).Scan(&count)
+				return err == nil && count == 1
+			}, 5*time.Second, 100*time.Millisecond)
+		}
+		history := func(con *websocket.Conn) response.HistoryPayload {
+			var payload response.HistoryPayload
+			require.NoError(t, readType(t, con, response.TypeHistory).Decode(&payload))
+			return payload
+		}
+
+		msg := say("read me")
+		stored(msg.ID)
+
+		env, err := response.NewEnvelope(response.TypeReceipt, "bad", response.ReceiptPayload{MessageID: msg.ID, Kind: "seen"})
+		require.NoError(t, err)
+		require.NoError(t, reader.WriteJSON(env))
+		var errPayload response.ErrorPayload
+		require.NoError(t, readType(t, reader, response.TypeError).Decode(&errPayload))
+		assert.Equal(t, response.ErrCodeBadRequest, errPayload.Code)
+
+		env, err = response.NewEnvelope(response.TypeReceipt, "read", response.ReceiptPayload{MessageID: msg.ID, Kind: response.ReceiptRead})
+		require.NoError(t, err)
+		require.NoError(t, reader.WriteJSON(env))
+		assert.Equal(t, "read", readType(t, reader, response.TypeAck).ID)
+
+		// sender sees who has read the message
+		var receipt response.ReceiptPayload
+		require.NoError(t, readType(t, author, response.TypeReceipt).Decode(&receipt))
+		assert.Equal(t, response.ReceiptPayload{MessageID: msg.ID, Kind: response.ReceiptRead, UserID: 1, Username: "first_test", Room: "general"}, receipt)
+
+		require.Eventually(t, func() bool {
+			var lastRead string
+			err := testPool.QueryRow(context.Background(), `SELECT last_read::text FROM read_markers WHERE user_id = 1 AND room = 'general'`).Scan(&lastRead)
+			return err == nil && lastRead == msg.ID
+		}, 5*time.Second, 100*time.Millisecond)
+
+		env, err = response.NewEnvelope(response.TypeReadBy, "seen", response.ReadByPayload{MessageID: msg.ID})
+		require.NoError(t, err)
+		require.NoError(t, author.WriteJSON(env))
+		var readBy response.ReadByPayload
+		require.NoError(t, readType(t, author, response.TypeReadBy).Decode(&readBy))
+		require.Len(t, readBy.Users, 1)
+		assert.Equal(t, "first_test", readBy.Users[0].Username)
+		assert.Equal(t, msg.ID, readBy.Users[0].LastRead)
+
+		// unread messages are counted on reconnect
+		require.NoError(t, reader.Close())
+		reader = dial(t, readerToken)
+		payload := history(reader)
+		assert.Equal(t, msg.ID, payload.LastRead)
+		assert.Zero(t, payload.Unread)
+
+		stored(say("unread").ID)
+		require.NoError(t, reader.Close())
+		reader = dial(t, readerToken)
+		defer func() {
+			assert.NoError(t, reader.Close())
+		}()
+		assert.Equal(t, 1, history(reader).Unread)
+	})
+	t.Run("HistoryPages", func(t *testing.T) {
+		con := dial(t, login(t, "first_test", password).Token)
+		defer func() {
+			assert.NoError(t, con.Close())
+		}()
+
+		env, err := response.NewEnvelope(response.TypeJoin, "join", response.JoinPayload{Room: "pages"})
+		require.NoError(t, err)
+		require.NoError(t, con.WriteJSON(env))
+		readType(t, con, response.TypeHistory)
+
+		// cache holds maxRecords+1 latest messages of the room
+		const total = maxRecords + 4
+		ids := make([]string, 0, total)
+		for i := 0; i < total; i++ {
+			env, err = response.NewEnvelope(response.TypeMessage, "", response.Msg{Text: fmt.Sprintf("page_%d", i)})
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+			var msg response.Msg
+			require.NoError(t, readType(t, con, response.TypeMessage).Decode(&msg))
+			ids = append(ids, msg.ID)
+		}
+		require.Eventually(t, func() bool {
+			var count int
+			err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM messages WHERE room = 'pages'`).Scan(&count)
+			return err == nil && count == total
+		}, 5*time.Second, 100*time.Millisecond)
+
+		page := func(before string, limit int) []string {
+			env, err := response.NewEnvelope(response.TypeHistory, "page", response.HistoryRequest{Before: before, Limit: limit})
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+			var payload response.HistoryPayload
+			reply := readType(t, con, response.TypeHistory)
+			assert.Equal(t, "page", reply.ID)
+			require.NoError(t, reply.Decode(&payload))
+			assert.Equal(t, before, payload.Before)
+			texts := make([]string, 0, len(payload.Messages))
+			for _, msg := range payload.Messages {
+				texts = append(texts, msg.Text)
+			}
+			return texts
+		}
+
+		// served from cache
+		assert.Equal(t, []string{"page_7", "page_8", "page_9"}, page(ids[10], 3))
+		// beyond cache messages are read from storage
+		assert.Equal(t, []string{"page_1", "page_2", "page_3", "page_4", "page_5"}, page(ids[6], 5))
+		assert.Equal(t, []string{"page_0"}, page(ids[1], 5))
+		assert.Empty(t, page(ids[0], 5))
+
+		env, err = response.NewEnvelope(response.TypeHistory, "big", response.HistoryRequest{Limit: 1000})
+		require.NoError(t, err)
+		require.NoError(t, con.WriteJSON(env))
+		var errPayload response.ErrorPayload
+		require.NoError(t, readType(t, con, response.TypeError).Decode(&errPayload))
+		assert.Equal(t, response.ErrCodeBadRequest, errPayload.Code)
+	})
+	t.Run("ReadAPI", func(t *testing.T) {
+		storageURL := "http://" + httpStorage
+		first := login(t, "first_test", password).Token
+		second := login(t, "second_test", password).Token
+		signer, err := auth.NewSigner(config.AuthCfg{SigningKey: authKey, TokenTTL: time.Minute})
+		require.NoError(t, err)
+		service, err := signer.ServiceToken()
+		require.NoError(t, err)
+
+		getJSON(t, storageURL+"/messages", "", http.StatusUnauthorized, &response.ErrResp{})
+		getJSON(t, storageURL+"/messages?limit=1000", first, http.StatusBadRequest, &response.ErrResp{})
+
+		texts := func(page response.MessagePage) []string {
+			res := make([]string, 0, len(page.Messages))
+			for _, msg := range page.Messages {
+				res = append(res, msg.Text)
+			}
+			return res
+		}
+
+		// cursor pages go from the newest message
+		var page response.MessagePage
+		getJSON(t, storageURL+"/messages?room=pages&limit=10", first, http.StatusOK, &page)
+		require.Len(t, page.Messages, 10)
+		assert.Equal(t, "page_14", page.Messages[0].Text)
+		require.NotEmpty(t, page.NextCursor)
+		getJSON(t, storageURL+"/messages?room=pages&limit=10&cursor="+page.NextCursor, first, http.StatusOK, &page)
+		assert.Equal(t, []string{"page_4", "page_3", "page_2", "page_1", "page_0"}, texts(page))
+		assert.Empty(t, page.NextCursor)
+
+		since := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+		getJSON(t, storageURL+"/messages?room=pages&since="+since, first, http.StatusOK, &page)
+		assert.Empty(t, page.Messages)
+
+		// direct message is visible to its participants and services only
+		getJSON(t, storageURL+"/messages?user_id=5", first, http.StatusOK, &page)
+		assert.Empty(t, page.Messages)
+		getJSON(t, storageURL+"/messages?user_id=5", service, http.StatusOK, &page)
+		assert.Equal(t, []string{"psst"}, texts(page))
+		getJSON(t, storageURL+"/messages?user_id=5", second, http.StatusOK, &page)
+		require.Equal(t, []string{"psst"}, texts(page))
+		dm := page.Messages[0]
+		assert.Equal(t, 2, dm.RecipientID)
+
+		var msg response.Msg
+		getJSON(t, storageURL+"/messages/"+dm.ID, second, http.StatusOK, &msg)
+		assert.Equal(t, dm, msg)
+		getJSON(t, storageURL+"/messages/"+dm.ID, first, http.StatusNotFound, &response.ErrResp{})
+
+		getJSON(t, storageURL+"/users/2/reads/general", first, http.StatusForbidden, &response.ErrResp{})
+
+		// service token has no user to chat on behalf of
+		header := http.Header{"Authorization": {"Bearer " + service}}
+		_, resp, err := websocket.DefaultDialer.Dial((&url.URL{Scheme: "ws", Host: httpServ, Path: chatPath}).String(), header)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+	t.Run("Search", func(t *testing.T) {
+		first := dial(t, login(t, "first_test", password).Token)
+		second := dial(t, login(t, "second_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{first, second} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		for _, text := range []string{"the quick brown fox", "lazy dog sleeps", "quick quick quick"} {
+			env, err := response.NewEnvelope(response.TypeMessage, "", response.Msg{Text: text})
+			require.NoError(t, err)
+			require.NoError(t, first.WriteJSON(env))
+			readType(t, first, response.TypeAck)
+		}
+		require.Eventually(t, func() bool {
+			var count int
+			err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM messages WHERE content = 'quick quick quick'`).Scan(&count)
+			return err == nil && count == 1
+		}, 5*time.Second, 100*time.Millisecond)
+
+		search := func(con *websocket.Conn, req response.SearchRequest) response.SearchPayload {
+			env, err := response.NewEnvelope(response.TypeSearch, "search", req)
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+			var payload response.SearchPayload
+			require.NoError(t, readType(t, con, response.TypeSearch).Decode(&payload))
+			return payload
+		}
+
+		// the most relevant message goes first, matched terms are highlighted
+		res := search(first, response.SearchRequest{Query: "Quick", Limit: 1})
+		require.Len(t, res.Results, 1)
+		assert.Equal(t, "quick quick quick", res.Results[0].Text)
+		assert.Contains(t, res.Results[0].Highlight, "**quick**")
+		assert.Equal(t, 1, res.NextOffset)
+
+		res = search(first, response.SearchRequest{Query: "Quick", Offset: res.NextOffset, Limit: 1})
+		require.Len(t, res.Results, 1)
+		assert.Equal(t, "the quick brown fox", res.Results[0].Text)
+		assert.Zero(t, res.NextOffset)
+
+		assert.Empty(t, search(first, response.SearchRequest{Query: "fox -brown"}).Results)
+
+		// direct message is found by its participants only
+		assert.Empty(t, search(first, response.SearchRequest{Query: "psst"}).Results)
+		res = search(second, response.SearchRequest{Query: "psst"})
+		require.Len(t, res.Results, 1)
+		assert.Equal(t, 2, res.Results[0].RecipientID)
+
+		var page response.SearchPage
+		getJSON(t, "http://"+httpStorage+"/messages/search?q=lazy", login(t, "third_test", newPassword).Token, http.StatusOK, &page)
+		require.Len(t, page.Results, 1)
+		assert.Contains(t, page.Results[0].Highlight, "**lazy**")
+	})
+	t.Run("RateLimit", func(t *testing.T) {
+		flooder := connect(t, "flood_test", 6)
+		defer func() {
+			// connection is dropped by server
+			_ = flooder.Close()
+		}()
+		token := login(t, "flood_test", password).Token
+
+		// messages over the burst are rejected, repeated violations mute and then disconnect
+		for i := 0; i < 2*msgBurst; i++ {
+			env, err := response.NewEnvelope(response.TypeMessage, strconv.Itoa(i), response.Msg{Text: "flood"})
+			require.NoError(t, err)
+			if err = flooder.WriteJSON(env); err != nil {
+				break
+			}
+		}
+		codes := make(map[string]bool)
+		require.NoError(t, flooder.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var err error
+		for {
+			var env response.Envelope
+			if err = flooder.ReadJSON(&env); err != nil {
+				break
+			}
+			if env.Type == response.TypeError {
+				var payload response.ErrorPayload
+				require.NoError(t, env.Decode(&payload))
+				codes[payload.Code] = true
+			}
+		}
+		assert.True(t, codes[response.ErrCodeRateLimited])
+		assert.True(t, codes[response.ErrCodeMuted])
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+
+		// new connections of the user are limited as well
+		urlDial := url.URL{Scheme: "ws", Host: httpServ, Path: chatPath}
+		header := http.Header{"Authorization": {"Bearer " + token}}
+		var limited bool
+		for i := 0; i < 2*connBurst && !limited; i++ {
+			con, resp, err := websocket.DefaultDialer.Dial(urlDial.String(), header)
+			if err != nil {
+				require.NotNil(t, resp)
+				require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+				limited = true
+				continue
+			}
+			require.NoError(t, con.Close())
+		}
+		assert.True(t, limited)
+
+		// frames which don't touch messages are limited by control buckets, malformed ones included
+		chatter := connect(t, "chatter_test", 7)
+		defer func() {
+			_ = chatter.Close()
+		}()
+		for i := 0; i < 2*ctlBurst; i++ {
+			if err = chatter.WriteMessage(websocket.TextMessage, []byte("{not json")); err != nil {
+				break
+			}
+		}
+		codes = make(map[string]bool)
+		require.NoError(t, chatter.SetReadDeadline(time.Now().Add(5*time.Second)))
+		for {
+			var env response.Envelope
+			if err = chatter.ReadJSON(&env); err != nil {
+				break
+			}
+			if env.Type == response.TypeError {
+				var payload response.ErrorPayload
+				require.NoError(t, env.Decode(&payload))
+				codes[payload.Code] = true
+			}
+		}
+		assert.True(t, codes[response.ErrCodeBadRequest])
+		assert.True(t, codes[response.ErrCodeRateLimited])
+		assert.False(t, codes[response.ErrCodeMuted])
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+	})
+	t.Run("Fanout", func(t *testing.T) {
+		local := dial(t, login(t, "first_test", password).Token)
+		remote := dialHost(t, httpServPeer, login(t, "second_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{local, remote} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+
+		// counts received messages by type and text until connection stays silent, connection can't be read afterwards
+		count := func(con *websocket.Conn) map[string]int {
+			counts := make(map[string]int)
+			require.NoError(t, con.SetReadDeadline(time.Now().Add(time.Second)))
+			for {
+				var env response.Envelope
+				if err := con.ReadJSON(&env); err != nil {
+					return counts
+				}
+				var msg response.Msg
+				if (env.Type == response.TypeMessage || env.Type == response.TypeDirect) && env.Decode(&msg) == nil {
+					counts[string(env.Type)+" "+msg.Text]++
+				}
+			}
+		}
+
+		// frames accepted by one instance reach every socket once
+		env, err := response.NewEnvelope(response.TypeMessage, "", response.Msg{Text: "across nodes"})
+		require.NoError(t, err)
+		require.NoError(t, local.WriteJSON(env))
+		env, err = response.NewEnvelope(response.TypeDirect, "", response.Msg{RecipientID: 1, Text: "back"})
+		require.NoError(t, err)
+		require.NoError(t, remote.WriteJSON(env))
+
+		expected := map[string]int{"message across nodes": 1, "direct back": 1}
+		assert.Equal(t, expected, count(local))
+		assert.Equal(t, expected, count(remote))
+	})
+	t.Run("FanoutResubscribe", func(t *testing.T) {
+		local := dial(t, login(t, "first_test", password).Token)
+		remote := dialHost(t, httpServPeer, login(t, "second_test", password).Token)
+		defer func() {
+			for _, con := range []*websocket.Conn{local, remote} {
+				assert.NoError(t, con.Close())
+			}
+		}()
+		// skip recent messages
+		time.Sleep(200 * time.Millisecond)
+
+		cfg, err := config.NewServerCfg()
+		require.NoError(t, err)
+		cache := redis.NewClient(&redis.Options{Addr: net.JoinHostPort(cfg.Redis.Host, cfg.Redis.Port)})
+		defer func() {
+			assert.NoError(t, cache.Close())
+		}()
+
+		// messages published while instances resubscribe are read from cache, each socket gets them once
+		require.NoError(t, cache.ClientKillByFilter(context.Background(), "TYPE", "pubsub").Err())
+		texts := []string{"while resubscribing", "after resubscribe"}
+		for _, text := range texts {
+			env, err := response.NewEnvelope(response.TypeMessage, "", response.Msg{Text: text})
+			require.NoError(t, err)
+			require.NoError(t, remote.WriteJSON(env))
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		for _, con := range []*websocket.Conn{local, remote} {
+			counts := make(map[string]int)
+			require.NoError(t, con.SetReadDeadline(time.Now().Add(5*time.Second)))
+			for counts[texts[1]] == 0 {
+				var env response.Envelope
+				require.NoError(t, con.ReadJSON(&env))
+				var msg response.Msg
+				if env.Type == response.TypeMessage && env.Decode(&msg) == nil {
+					counts[msg.Text]++
+				}
+			}
+			assert.Equal(t, map[string]int{texts[0]: 1, texts[1]: 1}, counts)
+		}
+	})
+	t.Run("Ordering", func(t *testing.T) {
+		const perSender = 10
+		local := dial(t, login(t, "first_test", password).Token)
+		remote := dialHost(t, httpServPeer, login(t, "second_test", password).Token)
+		conns := []*websocket.Conn{local, remote}
+		defer func() {
+			for _, con := range conns {
+				assert.NoError(t, con.Close())
+			}
+		}()
+		for _, con := range conns {
+			env, err := response.NewEnvelope(response.TypeJoin, "", response.JoinPayload{Room: "order"})
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+			readType(t, con, response.TypeHistory)
+		}
+
+		// both users send at once through different instances
+		var wg sync.WaitGroup
+		for i, con := range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perSender; j++ {
+					env, err := response.NewEnvelope(response.TypeMessage, "", response.Msg{Text: fmt.Sprintf("order_%d_%d", i, j)})
+					assert.NoError(t, err)
+					assert.NoError(t, con.WriteJSON(env))
+				}
+			}()
+		}
+		wg.Wait()
+
+		received := make([][]string, len(conns))
+		for i, con := range conns {
+			var prev int64
+			for len(received[i]) < len(conns)*perSender {
+				var msg response.Msg
+				require.NoError(t, readType(t, con, response.TypeMessage).Decode(&msg))
+				if prev != 0 {
+					assert.Equal(t, prev+1, msg.Seq)
+				}
+				prev = msg.Seq
+				received[i] = append(received[i], msg.ID)
+			}
+		}
+		assert.Equal(t, received[0], received[1])
+
+		var stored []string
+		require.Eventually(t, func() bool {
+			rows, err := testPool.Query(context.Background(), `SELECT message_id::text FROM messages WHERE room = 'order' ORDER BY seq`)
+			if err != nil {
+				return false
+			}
+			stored, err = pgx.CollectRows(rows, pgx.RowTo[string])
+			return err == nil && len(stored) == len(conns)*perSender
+		}, 5*time.Second, 100*time.Millisecond)
+		assert.Equal(t, received[0], stored)
+
+		var history response.HistoryPayload
+		env, err := response.NewEnvelope(response.TypeHistory, "", response.HistoryRequest{Limit: 5})
+		require.NoError(t, err)
+		require.NoError(t, local.WriteJSON(env))
+		require.NoError(t, readType(t, local, response.TypeHistory).Decode(&history))
+		cached := make([]string, 0, len(history.Messages))
+		for _, msg := range history.Messages {
+			cached = append(cached, msg.ID)
+		}
+		assert.Equal(t, received[0][len(received[0])-5:], cached)
+	})
+	t.Run("Resume", func(t *testing.T) {
+		room := url.Values{"room": {"resume"}}
+		readerToken := login(t, "first_test", password).Token
+		sender := dialQuery(t, httpServ, login(t, "second_test", password).Token, room)
+		defer func() {
+			assert.NoError(t, sender.Close())
+		}()
+
+		send := func(texts ...string) []response.Msg {
+			sent := make([]response.Msg, 0, len(texts))
+			for _, text := range texts {
+				env, err := response.NewEnvelope(response.TypeMessage, "", response.Msg{Text: text})
+				require.NoError(t, err)
+				require.NoError(t, sender.WriteJSON(env))
+				var msg response.Msg
+				require.NoError(t, readType(t, sender, response.TypeMessage).Decode(&msg))
+				sent = append(sent, msg)
+			}
+			return sent
+		}
+		// replayed reads resumed history pages until live message frame
+		replayed := func(con *websocket.Conn) ([]string, string) {
+			var texts []string
+			require.NoError(t, con.SetReadDeadline(time.Now().Add(5*time.Second)))
+			for {
+				var env response.Envelope
+				require.NoError(t, con.ReadJSON(&env))
+				switch env.Type {
+				case response.TypeHistory:
+					var history response.HistoryPayload
+					require.NoError(t, env.Decode(&history))
+					assert.True(t, history.Resumed)
+					for _, msg := range history.Messages {
+						texts = append(texts, msg.Text)
+					}
+				case response.TypeMessage:
+					var msg response.Msg
+					require.NoError(t, env.Decode(&msg))
+					return texts, msg.Text
+				}
+			}
+		}
+
+		seen := send("resume_0")
+		missed := send("resume_1", "resume_2", "resume_3")
+
+		// resumed by sequence number, live message follows the replay
+		resumed := dialQuery(t, httpServPeer, readerToken, url.Values{
+			"room":     {"resume"},
+			"last_seq": {strconv.FormatInt(seen[0].Seq, 10)},
+		})
+		send("resume_live")
+		texts, live := replayed(resumed)
+		assert.Equal(t, []string{"resume_1", "resume_2", "resume_3"}, texts)
+		assert.Equal(t, "resume_live", live)
+		assert.NoError(t, resumed.Close())
+
+		// resumed by message ID
+		resumed = dialQuery(t, httpServ, readerToken, url.Values{"room": {"resume"}, "last_id": {missed[1].ID}})
+		send("resume_next")
+		texts, live = replayed(resumed)
+		assert.Equal(t, []string{"resume_3", "resume_live"}, texts)
+		assert.Equal(t, "resume_next", live)
+		assert.NoError(t, resumed.Close())
+
+		// older missed messages are replayed from storage
+		last := send("resume_last")[0]
+		more := make([]string, 0, maxRecords+3)
+		for i := 0; i < maxRecords+3; i++ {
+			more = append(more, fmt.Sprintf("resume_more_%d", i))
+		}
+		send(more...)
+		require.Eventually(t, func() bool {
+			var count int
+			err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM messages WHERE room = 'resume'`).Scan(&count)
+			return err == nil && count == 7+len(more)
+		}, 5*time.Second, 100*time.Millisecond)
+		resumed = dialQuery(t, httpServ, readerToken, url.Values{"room": {"resume"}, "last_id": {last.ID}})
+		send("resume_end")
+		texts, live = replayed(resumed)
+		assert.Equal(t, more, texts)
+		assert.Equal(t, "resume_end", live)
+		assert.NoError(t, resumed.Close())
+
+		urlDial := url.URL{Scheme: "ws", Host: httpServ, Path: chatPath, RawQuery: "last_seq=first"}
+		_, resp, err := websocket.DefaultDialer.Dial(urlDial.String(), http.Header{"Authorization": {"Bearer " + readerToken}})
+		require.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("Idempotency", func(t *testing.T) {
+		con := dialQuery(t, httpServ, login(t, "second_test", password).Token, url.Values{"room": {"idempotent"}})
+		defer func() {
+			assert.NoError(t, con.Close())
+		}()
+		send := func(id string, msg response.Msg) {
+			env, err := response.NewEnvelope(response.TypeMessage, id, msg)
+			require.NoError(t, err)
+			require.NoError(t, con.WriteJSON(env))
+			assert.Equal(t, id, readType(t, con, response.TypeAck).ID)
+		}
+		key := uuid.NewString()
+
+		// resent message is acked, but not broadcast again
+		send("first", response.Msg{Text: "once", IdempotencyKey: key})
+		send("resent", response.Msg{Text: "once", IdempotencyKey: key})
+		send("other", response.Msg{Text: "other"})
+		var first, other response.Msg
+		require.NoError(t, readType(t, con, response.TypeMessage).Decode(&first))
+		require.NoError(t, readType(t, con, response.TypeMessage).Decode(&other))
+		assert.Equal(t, "once", first.Text)
+		assert.Equal(t, key, first.IdempotencyKey)
+		assert.Equal(t, "other", other.Text)
+		assert.Equal(t, other.ID, other.IdempotencyKey)
+
+		var stored []string
+		require.Eventually(t, func() bool {
+			rows, err := testPool.Query(context.Background(), `SELECT idempotency_key FROM messages WHERE room = 'idempotent' ORDER BY seq`)
+			if err != nil {
+				return false
+			}
+			stored, err = pgx.CollectRows(rows, pgx.RowTo[string])
+			return err == nil && len(stored) == 2
+		}, 5*time.Second, 100*time.Millisecond)
+		assert.Equal(t, []string{key, other.ID}, stored)
+
+		// replayed event doesn't revert later edit
+		edit, err := response.NewEnvelope(response.TypeEdit, "edit", response.EditPayload{MessageID: first.ID, Text: "edited"})
+		require.NoError(t, err)
+		require.NoError(t, con.WriteJSON(edit))
+		assert.Equal(t, "edit", readType(t, con, response.TypeAck).ID)
+		require.Eventually(t, func() bool {
+			var text string
+			err := testPool.QueryRow(context.Background(), `SELECT content FROM messages WHERE message_id = $1`, first.ID).Scan(&text)
+			return err == nil && text == "edited"
+		}, 5*time.Second, 100*time.Millisecond)
+
+		repo := pgrepo.PgRepo{Pool: testPool}
+		assert.ErrorIs(t, repo.AddMessage(context.Background(), first), usecase.ErrConflict)
+		replayed := first
+		replayed.ID = uuid.NewString()
+		assert.ErrorIs(t, repo.AddMessage(context.Background(), replayed), usecase.ErrConflict)
+		var count int
+		require.NoError(t, testPool.QueryRow(context.Background(),
+			`SELECT count(*) FROM messages WHERE room = 'idempotent'`).Scan(&count))
+		assert.Equal(t, 2, count)
+		var text string
+		require.NoError(t, testPool.QueryRow(context.Background(),
+			`SELECT content FROM messages WHERE message_id = $1`, first.ID).Scan(&text))
+		assert.Equal(t, "edited", text)
+
+		// claim left pending by server which failed while storing the message doesn't swallow resent message
+		cfg, err := config.NewServerCfg()
+		require.NoError(t, err)
+		cache := redis.NewClient(&redis.Options{Addr: net.JoinHostPort(cfg.Redis.Host, cfg.Redis.Port)})
+		defer func() {
+			assert.NoError(t, cache.Close())
+		}()
+		pendingKey := uuid.NewString()
+		require.NoError(t, cache.Set(context.Background(), "idem:2:"+pendingKey, "pending:"+uuid.NewString(), time.Minute).Err())
+		send("pending", response.Msg{Text: "taken over", IdempotencyKey: pendingKey})
+		var takenOver response.Msg
+		require.NoError(t, readType(t, con, response.TypeMessage).Decode(&takenOver))
+		assert.Equal(t, "taken over", takenOver.Text)
+		claim, err := cache.Get(context.Background(), "idem:2:"+pendingKey).Result()
+		require.NoError(t, err)
+		assert.Equal(t, takenOver.ID, claim)
+
+		long, err := response.NewEnvelope(response.TypeMessage, "long", response.Msg{Text: "long", IdempotencyKey: strings.Repeat("k", 65)})
+		require.NoError(t, err)
+		require.NoError(t, con.WriteJSON(long))
+		env := readType(t, con, response.TypeError)
+		assert.Equal(t, "long", env.ID)
+	})
+	t.Run("DeadLetter", func(t *testing.T) {
+		cfg, err := config.NewStorageCfg()
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		writer := &kafka.Writer{Addr: kafka.TCP(cfg.Kafka.Addr), Topic: cfg.Kafka.Topic}
+		defer func() {
+			assert.NoError(t, writer.Close())
+		}()
+		produce := func(t *testing.T, eventType response.EventType, payload any) (string, []byte) {
+			event, err := response.NewEvent(eventType, payload)
+			require.NoError(t, err)
+			key := "dead-" + uuid.NewString()
+			require.NoError(t, writer.WriteMessages(ctx, kafka.Message{Key: []byte(key), Value: event}))
+			return key, event
+		}
+		// read returns records of the topic with the key, reading until there are count of them
+		read := func(t *testing.T, topic, key string, count int) []kafka.Message {
+			reader := kafka.NewReader(kafka.ReaderConfig{
+				Brokers: []string{cfg.Kafka.Addr},
+				GroupID: uuid.NewString(),
+				Topic:   topic,
+			})
+			defer func() {
+				assert.NoError(t, reader.Close())
+			}()
+			var found []kafka.Message
+			for len(found) < count {
+				msg, err := reader.FetchMessage(ctx)
+				require.NoError(t, err)
+				if string(msg.Key) == key {
+					found = append(found, msg)
+				}
+			}
+			return found
+		}
+		stored := func(messageID string) bool {
+			var count int
+			err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM messages WHERE message_id = $1`, messageID).Scan(&count)
+			return err == nil && count == 1
+		}
+		msg := func(userID int, text string) response.Msg {
+			return response.Msg{ID: uuid.NewString(), UserID: userID, Room: "dead", Text: text, SentAt: time.Now().UTC()}
+		}
+
+		t.Run("Invalid", func(t *testing.T) {
+			// record lacking author can never be stored, it's moved aside without blocking the partition
+			key, poison := produce(t, response.EventMessage, msg(0, "poison"))
+			dead := read(t, cfg.Kafka.DeadLetterTopic, key, 1)[0]
+			assert.Equal(t, poison, dead.Value)
+			assert.Equal(t, "invalid", kakafka.Header(dead, kakafka.HeaderErrorKind))
+			assert.Equal(t, "1", kakafka.Header(dead, kakafka.HeaderAttempts))
+			assert.Equal(t, cfg.Kafka.Topic, kakafka.Header(dead, kakafka.HeaderTopic))
+			assert.Contains(t, kakafka.Header(dead, kakafka.HeaderError), "user ID was not provided")
+		})
+		t.Run("Rejected", func(t *testing.T) {
+			// Postgres text can't hold NUL character, retry can't help
+			key, _ := produce(t, response.EventMessage, msg(2, "nul\x00"))
+			dead := read(t, cfg.Kafka.DeadLetterTopic, key, 1)[0]
+			assert.Equal(t, "rejected", kakafka.Header(dead, kakafka.HeaderErrorKind))
+			assert.Equal(t, "1", kakafka.Header(dead, kakafka.HeaderAttempts))
+			assert.Contains(t, kakafka.Header(dead, kakafka.HeaderError), "rejected by database")
+		})
+
+		// author is unknown until the record is re-driven
+		orphan := msg(deadLetterUserID, "orphan")
+		var orphanKey string
+		t.Run("MissingReference", func(t *testing.T) {
+			orphanKey, _ = produce(t, response.EventMessage, orphan)
+			dead := read(t, cfg.Kafka.DeadLetterTopic, orphanKey, 1)[0]
+			assert.Equal(t, "rejected", kakafka.Header(dead, kakafka.HeaderErrorKind))
+			assert.Equal(t, strconv.Itoa(retryAttempts), kakafka.Header(dead, kakafka.HeaderAttempts))
+			assert.Contains(t, kakafka.Header(dead, kakafka.HeaderError), "referenced row is missing")
+			assert.False(t, stored(orphan.ID))
+		})
+		t.Run("Retry", func(t *testing.T) {
+			target := msg(2, "retry")
+			produce(t, response.EventMessage, target)
+			require.Eventually(t, func() bool { return stored(target.ID) }, 5*time.Second, 100*time.Millisecond)
+
+			// reactions are unavailable for a while, record waits for them instead of being dead-lettered
+			_, err := testPool.Exec(context.Background(), `CREATE OR REPLACE FUNCTION reactions_unavailable() RETURNS trigger AS $$
+				BEGIN RAISE EXCEPTION 'reactions are unavailable' USING ERRCODE = '40001'; END;
+				$$ LANGUAGE plpgsql;
+				CREATE TRIGGER reactions_unavailable BEFORE INSERT ON message_reactions
+				FOR EACH ROW EXECUTE FUNCTION reactions_unavailable();`)
+			require.NoError(t, err)
+			produce(t, response.EventReaction, response.MessageReaction{
+				MessageID: target.ID,
+				UserID:    2,
+				Emoji:     "👍",
+				ReactedAt: time.Now().UTC(),
+			})
+			// more time than all attempts of missing reference take
+			time.Sleep(2 * time.Second)
+			_, err = testPool.Exec(context.Background(), `DROP TRIGGER reactions_unavailable ON message_reactions;
+				DROP FUNCTION reactions_unavailable;`)
+			require.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				var count int
+				err := testPool.QueryRow(context.Background(),
+					`SELECT count(*) FROM message_reactions WHERE message_id = $1`, target.ID).Scan(&count)
+				return err == nil && count == 1
+			}, 5*time.Second, 100*time.Millisecond)
+		})
+		t.Run("Redrive", func(t *testing.T) {
+			require.NotEmpty(t, orphanKey)
+			_, err := testPool.Exec(context.Background(),
+				`INSERT INTO users (user_id, username, username_key) VALUES ($1, 'dead_letter', 'dead_letter')`, deadLetterUserID)
+			require.NoError(t, err)
+
+			// records which still can't be applied are dead-lettered again, run stops at them
+			require.NoError(t, deadletter.Run(ctx, config.DeadLetterCfg{
+				Kafka:     cfg.Kafka,
+				GroupID:   uuid.NewString(),
+				Wait:      5 * time.Second,
+				LoggerLVL: "info",
+			}, deadletter.Options{Redrive: true}))
+
+			assert.Eventually(t, func() bool { return stored(orphan.ID) }, 5*time.Second, 100*time.Millisecond)
+			redriven := read(t, cfg.Kafka.Topic, orphanKey, 2)[1]
+			for _, h := range redriven.Headers {
+				assert.NotContains(t, h.Key, kakafka.HeaderPrefix)
+			}
+		})
+	})
+	t.Run("OutboxPoison", func(t *testing.T) {
+		cfg, err := config.NewServerCfg()
+		require.NoError(t, err)
+		cache := redis.NewClient(&redis.Options{Addr: net.JoinHostPort(cfg.Redis.Host, cfg.Redis.Port)})
+		defer func() {
+			assert.NoError(t, cache.Close())
+		}()
+		ctx := context.Background()
+
+		// entry which can never be written to Kafka is moved aside instead of blocking the stream
+		id, err := cache.XAdd(ctx, &redis.XAddArgs{Stream: cfg.Outbox.Stream, Values: []string{"key", "poison"}}).Result()
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			dead, err := cache.XRange(ctx, cfg.Outbox.Stream+":dead", "-", "+").Result()
+			if err != nil {
+				return false
+			}
+			for _, m := range dead {
+				if m.Values["entry"] == id {
+					left, err := cache.XRange(ctx, cfg.Outbox.Stream, id, id).Result()
+					return err == nil && len(left) == 0
+				}
+			}
+			return false
+		}, 30*time.Second, 100*time.Millisecond)
+	})
+	t.Run("DrainedEmptyTopic", func(t *testing.T) {
+		cfg, err := config.NewStorageCfg()
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		// partitions without records and group without commits must not keep reads waiting
+		cfg.Kafka.Topic = "empty-" + uuid.NewString()
+		cfg.Kafka.GroupID = uuid.NewString()
+		client := &kafka.Client{Addr: kafka.TCP(cfg.Kafka.Addr)}
+		resp, err := client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: []kafka.TopicConfig{{
+			Topic:             cfg.Kafka.Topic,
+			NumPartitions:     3,
+			ReplicationFactor: 1,
+		}}})
+		require.NoError(t, err)
+		require.NoError(t, resp.Errors[cfg.Kafka.Topic])
+
+		lag := kakafka.NewLag(cfg.Kafka)
+		assert.Eventually(t, func() bool {
+			return lag.WaitDrained(ctx, time.Second) == nil
+		}, 10*time.Second, 100*time.Millisecond)
+	})
 }
 
 func sendMsg(con *websocket.Conn, amount int) error {
 	var sent int
 	for sent < amount {
-		msg := response.Msg{
-			Username: "second_test",
+		// forged identity must be replaced by the one bound to connection
+		env, err := response.NewEnvelope(response.TypeMessage, strconv.Itoa(sent), response.Msg{
+			UserID:   1,
+			Username: "impostor",
 			Text:     fmt.Sprintf("test_%d", sent),
+		})
+		if err != nil {
+			return err
 		}
-		if err := con.WriteJSON(msg); err != nil {
+		if err = con.WriteJSON(env); err != nil {
 			return err
 		}
 		sent++
@@ -161,27 +1617,144 @@ func sendMsg(con *websocket.Conn, amount int) error {
 func testReceive(t *testing.T, con *websocket.Conn, amount int) {
 	t.Helper()
 	var sent int
+	var prevID string
+	check := func(msg response.Msg) {
+		assert.Equal(t, 2, msg.UserID)
+		assert.Equal(t, "second_test", msg.Username)
+		assert.Equal(t, "general", msg.Room)
+		assert.Equal(t, fmt.Sprintf("test_%d", sent), msg.Text)
+		assert.False(t, msg.SentAt.IsZero())
+		// server assigned IDs are time ordered
+		assert.Greater(t, msg.ID, prevID)
+		prevID = msg.ID
+		sent++
+	}
 	for sent < amount {
-		_, message, err := con.ReadMessage()
-		assert.NoError(t, err)
+		var env response.Envelope
+		if !assert.NoError(t, con.ReadJSON(&env)) {
+			return
+		}
 
-		msg := strings.TrimSuffix(string(message), "\n")
-		assert.Equal(t, fmt.Sprintf("{\"user_id\":2,\"username\":\"second_test\",\"text\":\"test_%d\"}", sent), msg)
-		sent++
+		switch env.Type {
+		case response.TypeMessage:
+			var msg response.Msg
+			assert.NoError(t, env.Decode(&msg))
+			check(msg)
+		case response.TypeHistory:
+			var history response.HistoryPayload
+			assert.NoError(t, env.Decode(&history))
+			for _, msg := range history.Messages {
+				check(msg)
+			}
+		default:
+			// acks and other service frames are not counted
+		}
 	}
 }
 
-func registerTest(t *testing.T, con *websocket.Conn, username string, expect int) {
+// connect registers user in storage service, logs in and opens WS connection authenticated by issued token
+func connect(t *testing.T, username string, expect int) *websocket.Conn {
 	t.Helper()
-	err := con.WriteMessage(websocket.TextMessage, []byte(username))
-	require.NoError(t, err)
-	// wait server to process msg
-	time.Sleep(1000 * time.Millisecond)
-	var count int
+	var registered response.RegisterResp
+	postJSON(t, "/register", response.RegisterReq{Username: username, Password: password}, http.StatusCreated, &registered)
+	require.Equal(t, expect, registered.UserID)
+	token := login(t, username, password).Token
 
-	err = testPool.QueryRow(context.Background(), `SELECT count(*) FROM users`).Scan(&count)
+	var count int
+	err := testPool.QueryRow(context.Background(), `SELECT count(*) FROM users`).Scan(&count)
 	assert.NoError(t, err)
 	assert.Equal(t, expect, count)
+
+	return dial(t, token)
+}
+
+// dial opens WS connection authenticated by token
+func dial(t *testing.T, token string) *websocket.Conn {
+	t.Helper()
+	return dialHost(t, httpServ, token)
+}
+
+// dialHost opens WS connection to given server instance
+func dialHost(t *testing.T, host, token string) *websocket.Conn {
+	t.Helper()
+	return dialQuery(t, host, token, nil)
+}
+
+// dialQuery opens WS connection passing query parameters of upgrade request (e.g. room and resume point)
+func dialQuery(t *testing.T, host, token string, query url.Values) *websocket.Conn {
+	t.Helper()
+	urlDial := url.URL{Scheme: "ws", Host: host, Path: chatPath, RawQuery: query.Encode()}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	con, _, err := websocket.DefaultDialer.Dial(urlDial.String(), header)
+	require.NoError(t, err)
+	// wait server to register connection
+	time.Sleep(100 * time.Millisecond)
+
+	return con
+}
+
+// readType reads frames until envelope of given type, skipping others
+func readType(t *testing.T, con *websocket.Conn, typ response.EnvelopeType) response.Envelope {
+	t.Helper()
+	require.NoError(t, con.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		var env response.Envelope
+		require.NoError(t, con.ReadJSON(&env))
+		if env.Type == typ {
+			return env
+		}
+	}
+}
+
+func login(t *testing.T, username, pass string) response.LoginResp {
+	t.Helper()
+	var loginResp response.LoginResp
+	postJSON(t, "/login", response.LoginReq{Username: username, Password: pass}, http.StatusOK, &loginResp)
+	require.NotEmpty(t, loginResp.Token)
+
+	return loginResp
+}
+
+// serviceToken issues token of internal service
+func serviceToken(t *testing.T) string {
+	t.Helper()
+	signer, err := auth.NewSigner(config.AuthCfg{SigningKey: authKey, TokenTTL: time.Minute})
+	require.NoError(t, err)
+	token, err := signer.ServiceToken()
+	require.NoError(t, err)
+	return token
+}
+
+// postJSON sends request to storage service and decodes response into v (if not nil)
+func postJSON(t *testing.T, path string, body any, status int, v any) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	resp, err := http.Post("http://"+httpStorage+path, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, status, resp.StatusCode)
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+}
+
+// getJSON sends request authenticated by token (if not empty) and decodes response into v
+func getJSON(t *testing.T, reqURL, token string, status int, v any) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, status, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
 }
 
 func healthcheck(serviceURL string) error {
@@ -223,6 +1796,6 @@ func setupDB() (func() error, error) {
 	}
 
 	return func() error {
-		return migrations.Down(testPool, migrationPath)
+		return migrations.Reset(testPool, migrationPath)
 	}, nil
 }
@@ -0,0 +1,150 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const requestTimeout = 5 * time.Second
+
+var ErrNotFound = errors.New("not found")
+
+// ServiceTokenIssuer signs tokens authenticating server in storage service
+type ServiceTokenIssuer interface {
+	ServiceToken() (string, error)
+}
+
+// Directory resolves accounts and stored messages via storage service
+type Directory struct {
+	baseURL string
+	client  *http.Client
+	tokens  ServiceTokenIssuer
+}
+
+func New(cfg config.StorageAddr, tokens ServiceTokenIssuer) *Directory {
+	return &Directory{
+		baseURL: "http://" + net.JoinHostPort(cfg.Host, cfg.Port),
+		client:  &http.Client{Timeout: requestTimeout},
+		tokens:  tokens,
+	}
+}
+
+func (d *Directory) UserByID(ctx context.Context, userID int) (response.User, error) {
+	var user response.User
+	err := d.get(ctx, d.baseURL+"/users/"+strconv.Itoa(userID), &user)
+	return user, err
+}
+
+func (d *Directory) UserByName(ctx context.Context, username string) (response.User, error) {
+	var user response.User
+	err := d.get(ctx, d.baseURL+"/users?"+url.Values{"username": {username}}.Encode(), &user)
+	return user, err
+}
+
+func (d *Directory) MessageByID(ctx context.Context, messageID string) (response.Msg, error) {
+	var msg response.Msg
+	err := d.get(ctx, d.baseURL+"/messages/"+url.PathEscape(messageID), &msg)
+	return msg, err
+}
+
+// LastSeq returns sequence number of the latest stored message of the room
+func (d *Directory) LastSeq(ctx context.Context, room string) (int64, error) {
+	var info response.RoomInfo
+	err := d.get(ctx, d.baseURL+"/rooms/"+url.PathEscape(room), &info)
+	return info.LastSeq, err
+}
+
+// RoomSince returns up to limit stored messages of the room following the sequence number in sequence order
+func (d *Directory) RoomSince(ctx context.Context, room string, after int64, limit int) ([]response.Msg, error) {
+	query := url.Values{
+		"after_seq": {strconv.FormatInt(after, 10)},
+		"limit":     {strconv.Itoa(limit)},
+	}
+	var messages []response.Msg
+	err := d.get(ctx, d.baseURL+"/rooms/"+url.PathEscape(room)+"/messages?"+query.Encode(), &messages)
+	return messages, err
+}
+
+// RoomHistory returns up to limit stored messages of the room preceding the message in sequence order
+func (d *Directory) RoomHistory(ctx context.Context, room, before string, limit int) ([]response.Msg, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if before != "" {
+		query.Set("before", before)
+	}
+	var messages []response.Msg
+	err := d.get(ctx, d.baseURL+"/rooms/"+url.PathEscape(room)+"/messages?"+query.Encode(), &messages)
+	return messages, err
+}
+
+// Search runs full-text search over messages visible to the viewer
+func (d *Directory) Search(ctx context.Context, viewerID int, req response.SearchRequest) (response.SearchPage, error) {
+	query := url.Values{
+		"q":         {req.Query},
+		"viewer_id": {strconv.Itoa(viewerID)},
+		"offset":    {strconv.Itoa(req.Offset)},
+		"limit":     {strconv.Itoa(req.Limit)},
+	}
+	var page response.SearchPage
+	err := d.get(ctx, d.baseURL+"/messages/search?"+query.Encode(), &page)
+	return page, err
+}
+
+// ReadState returns read position of the user in the room
+func (d *Directory) ReadState(ctx context.Context, userID int, room string) (response.ReadState, error) {
+	var state response.ReadState
+	err := d.get(ctx, d.baseURL+"/users/"+strconv.Itoa(userID)+"/reads/"+url.PathEscape(room), &state)
+	return state, err
+}
+
+// Reactions returns stored reactions of the message
+func (d *Directory) Reactions(ctx context.Context, messageID string) ([]response.MessageReaction, error) {
+	var reactions []response.MessageReaction
+	err := d.get(ctx, d.baseURL+"/messages/"+url.PathEscape(messageID)+"/reactions", &reactions)
+	return reactions, err
+}
+
+// ReadBy returns users who have read the room up to the message
+func (d *Directory) ReadBy(ctx context.Context, room, messageID string) ([]response.ReadMarker, error) {
+	var markers []response.ReadMarker
+	err := d.get(ctx, d.baseURL+"/rooms/"+url.PathEscape(room)+"/reads?"+url.Values{"message_id": {messageID}}.Encode(), &markers)
+	return markers, err
+}
+
+// get decodes response into v, ErrNotFound is returned on 404
+func (d *Directory) get(ctx context.Context, reqURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err
+	}
+	token, err := d.tokens.ServiceToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("lookup failed with status %d", resp.StatusCode)
+	}
+
+	return render.DecodeJSON(resp.Body, v)
+}
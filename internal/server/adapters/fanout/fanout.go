@@ -0,0 +1,202 @@
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/rediska"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	// publishAttempts how many times broadcast is published before it's dropped
+	publishAttempts = 3
+	// publishRetryDelay pause between publish attempts
+	publishRetryDelay = 100 * time.Millisecond
+)
+
+// Fanout shares broadcasts between server instances via Redis Pub/Sub. Every instance, including the one which
+// accepted a frame, delivers frames of the channels to its own connections in the order they were published, so
+// each socket gets a frame once and all sockets get frames in the same order. Pub/Sub drops frames published while
+// subscription is down, room messages missed this way are read from cache by their sequence numbers
+type Fanout struct {
+	client   *redis.Client
+	cache    *rediska.Rediska
+	channel  string
+	messages string
+	log      zerolog.Logger
+}
+
+// New creates fanout of the instance
+func New(cache *rediska.Rediska, cfg config.FanoutCfg, log zerolog.Logger) *Fanout {
+	return &Fanout{
+		client:   cache.Client,
+		cache:    cache,
+		channel:  cfg.Channel,
+		messages: cfg.MessageChannel,
+		log:      log,
+	}
+}
+
+// Relay Single run of fanout (supposed to be called only once). Returned channel accepts broadcasts of local
+// connections, each of them is published to all instances. Broadcasts of all instances and room messages published
+// by cache are passed to local broadcaster
+func (f *Fanout) Relay(ctx context.Context, local chan<- response.Broadcast) (chan<- response.Broadcast, error) {
+	// single subscription keeps order of frames across both channels
+	sub := f.client.Subscribe(ctx, f.channel, f.messages)
+	// subscription must be confirmed, otherwise frames published right after start are missed
+	for range []string{f.channel, f.messages} {
+		if _, err := sub.Receive(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	outgoing := make(chan response.Broadcast)
+	go f.publish(ctx, outgoing)
+	go f.receive(ctx, sub, local)
+	return outgoing, nil
+}
+
+func (f *Fanout) publish(ctx context.Context, outgoing <-chan response.Broadcast) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-outgoing:
+			data, err := json.Marshal(b)
+			if err != nil {
+				f.log.Error().Err(err).Msg("failed to marshal fanout frame")
+				continue
+			}
+			for attempt := 1; ; attempt++ {
+				err = f.client.Publish(ctx, f.channel, data).Err()
+				if err == nil || attempt == publishAttempts || ctx.Err() != nil {
+					break
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(publishRetryDelay):
+				}
+			}
+			if err != nil {
+				f.log.Error().Err(err).Msg("failed to publish fanout frame")
+			}
+		}
+	}
+}
+
+// receive passes frames of the subscription to local broadcaster. Once subscription is restored after reconnect,
+// messages of the rooms published meanwhile are read from cache
+func (f *Fanout) receive(ctx context.Context, sub *redis.PubSub, local chan<- response.Broadcast) {
+	defer func() {
+		if err := sub.Close(); err != nil {
+			f.log.Error().Err(err).Msg("failed to close fanout subscription")
+		}
+	}()
+
+	// last sequence number of each room passed to local broadcaster
+	last := make(map[string]int64)
+	frames := sub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				f.log.Error().Msg("fanout subscription is closed")
+				return
+			}
+			switch frame := frame.(type) {
+			case *redis.Subscription:
+				// initial confirmations are consumed by Relay, so this one follows reconnect
+				if frame.Kind != "subscribe" || frame.Channel != f.messages {
+					continue
+				}
+				f.log.Warn().Int("rooms", len(last)).Msg("fanout is resubscribed, filling missed messages")
+				for room := range last {
+					if !f.fill(ctx, local, last, room) {
+						return
+					}
+				}
+			case *redis.Message:
+				if !f.deliver(ctx, local, last, frame) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver passes frame of either channel to local broadcaster, message channel carries bare room messages. It
+// reports false once ctx is done
+func (f *Fanout) deliver(ctx context.Context, local chan<- response.Broadcast, last map[string]int64, frame *redis.Message) bool {
+	if frame.Channel != f.messages {
+		var b response.Broadcast
+		if err := json.Unmarshal([]byte(frame.Payload), &b); err != nil {
+			f.log.Error().Err(err).Str("channel", frame.Channel).Msg("failed to decode fanout frame")
+			return true
+		}
+		return send(ctx, local, b)
+	}
+
+	var msg response.Msg
+	if err := json.Unmarshal([]byte(frame.Payload), &msg); err != nil {
+		f.log.Error().Err(err).Str("channel", frame.Channel).Msg("failed to decode fanout frame")
+		return true
+	}
+	if prev, ok := last[msg.Room]; ok && msg.Seq > prev+1 {
+		// messages between were not received
+		if !f.fill(ctx, local, last, msg.Room) {
+			return false
+		}
+	}
+	return f.deliverMessage(ctx, local, last, msg)
+}
+
+// fill passes to local broadcaster cached messages of the room following the last passed one
+func (f *Fanout) fill(ctx context.Context, local chan<- response.Broadcast, last map[string]int64, room string) bool {
+	missed, complete, err := f.cache.GetSince(ctx, room, last[room])
+	if err != nil {
+		f.log.Error().Err(err).Str("room", room).Msg("failed to read missed messages")
+		return ctx.Err() == nil
+	}
+	if !complete {
+		f.log.Warn().Str("room", room).Int64("after_seq", last[room]).Msg("missed messages are partially evicted from cache")
+	}
+	for _, msg := range missed {
+		if !f.deliverMessage(ctx, local, last, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverMessage passes room message to local broadcaster unless it was already passed
+func (f *Fanout) deliverMessage(ctx context.Context, local chan<- response.Broadcast, last map[string]int64, msg response.Msg) bool {
+	if prev, ok := last[msg.Room]; ok && msg.Seq <= prev {
+		return true
+	}
+	env, err := response.NewEnvelope(response.TypeMessage, "", msg)
+	if err != nil {
+		f.log.Error().Err(err).Msg("failed to wrap fanout message")
+		return true
+	}
+	if !send(ctx, local, response.Broadcast{Room: msg.Room, UserID: msg.UserID, Envelope: env}) {
+		return false
+	}
+	last[msg.Room] = msg.Seq
+	return true
+}
+
+func send(ctx context.Context, local chan<- response.Broadcast, b response.Broadcast) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case local <- b:
+		return true
+	}
+}
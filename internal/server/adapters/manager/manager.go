@@ -2,83 +2,420 @@ package manager
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
+	"github.com/vlasashk/websocket-chat/config"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
-const workers = 5
+const (
+	workers = 5
+
+	// PolicyDropOldest discards the oldest queued frame to make room for the new one
+	PolicyDropOldest = "drop_oldest"
+	// PolicyDisconnect closes connection of client which is not able to keep up
+	PolicyDisconnect = "disconnect"
+
+	overflowCloseReason = "send queue overflow"
+	closeWriteWait      = time.Second
+)
+
+var ErrUnknownClient = errors.New("client is not registered")
 
 type Manager struct {
-	clients map[*websocket.Conn]struct{}
-	// mu for sync access to clients
-	mu *sync.RWMutex
-	// wsMu for sync write operation to WS
-	wsMu *sync.Mutex
-	log  zerolog.Logger
+	// clients maps connection to its outbound queue
+	clients map[*websocket.Conn]*client
+	// rooms maps room name to the set of its clients
+	rooms map[string]map[*client]struct{}
+	// users maps user ID to the set of connections of the user
+	users map[int]map[*client]struct{}
+	// mu for sync access to clients, rooms and users
+	mu        *sync.RWMutex
+	queueSize int
+	policy    string
+	writeWait time.Duration
+	log       zerolog.Logger
 }
 
-func New(log zerolog.Logger) *Manager {
+// client single connection with its own writer goroutine and bounded outbound queue
+type client struct {
+	con       *websocket.Conn
+	room      string
+	user      response.User
+	send      chan response.Envelope
+	done      chan struct{}
+	overflow  sync.Once
+	closeOnce sync.Once
+	closeErr  error
+	// holdMu guards held frames broadcast to resuming connection, which are queued once missed messages are replayed
+	holdMu  sync.Mutex
+	holding bool
+	held    []response.Envelope
+}
+
+func New(log zerolog.Logger, cfg config.SendQueueCfg, writeWait time.Duration) (*Manager, error) {
+	if cfg.Size <= 0 {
+		return nil, fmt.Errorf("send queue size must be positive: %d", cfg.Size)
+	}
+	switch cfg.OverflowPolicy {
+	case PolicyDropOldest, PolicyDisconnect:
+	default:
+		return nil, fmt.Errorf("unknown send queue overflow policy: %q", cfg.OverflowPolicy)
+	}
+
 	return &Manager{
-		clients: make(map[*websocket.Conn]struct{}),
-		mu:      &sync.RWMutex{},
-		wsMu:    &sync.Mutex{},
-		log:     log,
+		clients:   make(map[*websocket.Conn]*client),
+		rooms:     make(map[string]map[*client]struct{}),
+		users:     make(map[int]map[*client]struct{}),
+		mu:        &sync.RWMutex{},
+		queueSize: cfg.Size,
+		policy:    cfg.OverflowPolicy,
+		writeWait: writeWait,
+		log:       log,
+	}, nil
+}
+
+// Store registers connection of the user in the room
+func (m *Manager) Store(con *websocket.Conn, room string, user response.User) {
+	m.store(con, room, user, false)
+}
+
+// StoreHeld registers connection of the user in the room holding frames broadcast to it until Resume, frames written
+// directly are queued meanwhile (e.g. replay of missed messages)
+func (m *Manager) StoreHeld(con *websocket.Conn, room string, user response.User) {
+	m.store(con, room, user, true)
+}
+
+// Resume queues frames held for connection since StoreHeld, skipping the ones keep rejects, and switches it to
+// live delivery
+func (m *Manager) Resume(con *websocket.Conn, keep func(env response.Envelope) bool) error {
+	m.mu.RLock()
+	c, ok := m.clients[con]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrUnknownClient
 	}
+
+	// frames broadcast meanwhile wait for the lock, so they are queued after held ones
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	for _, env := range c.held {
+		if keep(env) {
+			m.enqueue(c, env)
+		}
+	}
+	c.held = nil
+	c.holding = false
+	return nil
+}
+
+func (m *Manager) store(con *websocket.Conn, room string, user response.User, held bool) {
+	c := &client{
+		con:     con,
+		user:    user,
+		send:    make(chan response.Envelope, m.queueSize),
+		done:    make(chan struct{}),
+		holding: held,
+	}
+
+	m.mu.Lock()
+	m.clients[con] = c
+	add(m.users, user.UserID, c)
+	m.join(c, room)
+	m.mu.Unlock()
+
+	go m.writer(c)
 }
 
-func (m *Manager) Store(con *websocket.Conn) {
+// Join moves connection to the given room, leaving the previous one
+func (m *Manager) Join(con *websocket.Conn, room string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.clients[con] = struct{}{}
+	c, ok := m.clients[con]
+	if !ok || c.room == room {
+		return
+	}
+	m.leave(c)
+	m.join(c, room)
 }
 
-func (m *Manager) WriteMsg(con *websocket.Conn, msg response.Msg) error {
-	m.wsMu.Lock()
-	defer m.wsMu.Unlock()
-	return con.WriteJSON(msg)
+// Write enqueues frame to connection's outbound queue
+func (m *Manager) Write(con *websocket.Conn, env response.Envelope) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.clients[con]
+	if !ok {
+		return ErrUnknownClient
+	}
+	m.enqueue(c, env)
+	return nil
 }
 
+// Release unregisters connection. Its writer flushes already queued frames and closes the connection
 func (m *Manager) Release(con *websocket.Conn) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	c, ok := m.clients[con]
+	if ok {
+		delete(m.clients, con)
+		remove(m.users, c.user.UserID, c)
+		m.leave(c)
+	}
+	m.mu.Unlock()
 
-	if err := con.Close(); err != nil {
-		m.log.Error().Err(err).Msg("failed to close ws client")
+	if !ok {
+		if err := con.Close(); err != nil {
+			m.log.Error().Err(err).Msg("failed to close ws client")
+		}
+		return
 	}
-	delete(m.clients, con)
+	close(c.done)
 }
 
-// Broadcaster Single run of broadcast worker pool, exposing channel to share among all clients (supposed to be called only once)
-func (m *Manager) Broadcaster(ctx context.Context) chan<- response.Msg {
-	data := make(chan response.Msg, workers)
-	for w := 0; w < workers; w++ {
-		go m.broadcast(ctx, data)
+// Broadcaster Single run of broadcast worker pool, exposing channel to share among all clients (supposed to be called only once).
+// Each room (each pair of users for direct frames) is served by single worker, so its frames are delivered to clients
+// in the order they are passed
+func (m *Manager) Broadcaster(ctx context.Context) chan<- response.Broadcast {
+	data := make(chan response.Broadcast, workers)
+	shards := make([]chan response.Broadcast, workers)
+	for w := range shards {
+		shards[w] = make(chan response.Broadcast, workers)
+		go m.broadcast(ctx, shards[w])
 	}
+	go m.dispatch(ctx, data, shards)
 	return data
 }
 
-func (m *Manager) broadcast(ctx context.Context, messages <-chan response.Msg) {
+// dispatch passes frames to the worker serving their room
+func (m *Manager) dispatch(ctx context.Context, frames <-chan response.Broadcast, shards []chan response.Broadcast) {
+	defer func() {
+		for _, shard := range shards {
+			close(shard)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b, ok := <-frames:
+			if !ok {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case shards[shardOf(b, len(shards))] <- b:
+			}
+		}
+	}
+}
+
+// shardOf picks worker by room of the frame, direct frames by the pair of sender and recipient
+func shardOf(b response.Broadcast, shards int) int {
+	key := b.Room
+	if b.RecipientID != 0 {
+		low, high := b.UserID, b.RecipientID
+		if low > high {
+			low, high = high, low
+		}
+		key = strconv.Itoa(low) + ":" + strconv.Itoa(high)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+func (m *Manager) broadcast(ctx context.Context, frames <-chan response.Broadcast) {
 	for {
 		select {
 		case <-ctx.Done():
 			m.log.Error().Msg("BroadCast ctx deadline")
 			return
-		case msg, ok := <-messages:
+		case b, ok := <-frames:
 			if !ok {
 				m.log.Error().Msg("BroadCast is dead")
 				return
 			}
+			if b.RecipientID != 0 {
+				m.direct(b)
+				continue
+			}
+			// enqueue never blocks, so slow clients don't hold the lock
 			m.mu.RLock()
-			for con := range m.clients {
-				if err := m.WriteMsg(con, msg); err != nil {
-					m.log.Error().Err(err).Send()
+			for c := range m.rooms[b.Room] {
+				if b.ExcludeUserID != 0 && c.user.UserID == b.ExcludeUserID {
+					continue
 				}
+				m.deliver(c, b.Envelope)
 			}
 			m.mu.RUnlock()
 		}
 	}
 }
+
+// direct delivers private frame to all connections of recipient and sender only
+func (m *Manager) direct(b response.Broadcast) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for c := range m.users[b.RecipientID] {
+		m.deliver(c, b.Envelope)
+	}
+	if b.UserID == b.RecipientID {
+		return
+	}
+	for c := range m.users[b.UserID] {
+		m.deliver(c, b.Envelope)
+	}
+}
+
+// deliver passes broadcast frame to client's queue, frame is held while client is resuming
+func (m *Manager) deliver(c *client, env response.Envelope) {
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	if !c.holding {
+		m.enqueue(c, env)
+		return
+	}
+	if len(c.held) == m.queueSize {
+		// held frames are bounded same as the queue
+		if m.policy == PolicyDisconnect {
+			m.overflowed(c)
+			return
+		}
+		c.held = c.held[1:]
+		m.log.Warn().Str("policy", m.policy).Msg("held frames overflow, dropped oldest frame")
+	}
+	c.held = append(c.held, env)
+}
+
+// enqueue puts frame to client's queue applying overflow policy when the queue is full
+func (m *Manager) enqueue(c *client, env response.Envelope) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case c.send <- env:
+			return
+		default:
+		}
+
+		if m.policy == PolicyDisconnect {
+			m.overflowed(c)
+			return
+		}
+
+		// drop oldest and retry, other broadcast workers may race for the freed slot
+		select {
+		case <-c.send:
+			m.log.Warn().Str("policy", m.policy).Msg("send queue overflow, dropped oldest frame")
+		default:
+		}
+	}
+}
+
+// overflowed disconnects client which is not able to keep up
+func (m *Manager) overflowed(c *client) {
+	c.overflow.Do(func() {
+		m.log.Warn().Str("policy", m.policy).Msg("send queue overflow, disconnecting client")
+		go m.disconnect(c, overflowCloseReason)
+	})
+}
+
+// writer the only goroutine writing data frames to client's connection
+func (m *Manager) writer(c *client) {
+	defer func() {
+		if err := c.close(); err != nil {
+			m.log.Error().Err(err).Msg("failed to close ws client")
+		}
+	}()
+	for {
+		select {
+		case <-c.done:
+			m.flush(c)
+			return
+		case env := <-c.send:
+			if err := c.con.SetWriteDeadline(time.Now().Add(m.writeWait)); err != nil {
+				m.log.Error().Err(err).Send()
+				return
+			}
+			if err := c.con.WriteJSON(env); err != nil {
+				m.log.Error().Err(err).Send()
+				return
+			}
+		}
+	}
+}
+
+// flush writes frames left in the queue of released client (e.g. error sent right before release)
+func (m *Manager) flush(c *client) {
+	if err := c.con.SetWriteDeadline(time.Now().Add(closeWriteWait)); err != nil {
+		return
+	}
+	for {
+		select {
+		case env := <-c.send:
+			if err := c.con.WriteJSON(env); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// disconnect closes connection notifying client with close reason. Reader of the connection
+// fails on the next read and releases the client
+func (m *Manager) disconnect(c *client, reason string) {
+	closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if err := c.con.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(closeWriteWait)); err != nil {
+		m.log.Error().Err(err).Msg("failed to send close message")
+	}
+	if err := c.close(); err != nil {
+		m.log.Error().Err(err).Msg("failed to close ws client")
+	}
+}
+
+func (c *client) close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.con.Close()
+	})
+	return c.closeErr
+}
+
+// join must be called with mu held
+func (m *Manager) join(c *client, room string) {
+	add(m.rooms, room, c)
+	c.room = room
+}
+
+// leave must be called with mu held
+func (m *Manager) leave(c *client) {
+	remove(m.rooms, c.room, c)
+}
+
+// add puts client to the set under the key, creating the set if needed
+func add[K comparable](sets map[K]map[*client]struct{}, key K, c *client) {
+	members, ok := sets[key]
+	if !ok {
+		members = make(map[*client]struct{})
+		sets[key] = members
+	}
+	members[c] = struct{}{}
+}
+
+// remove deletes client from the set under the key, dropping the set once it's empty
+func remove[K comparable](sets map[K]map[*client]struct{}, key K, c *client) {
+	members := sets[key]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(sets, key)
+	}
+}
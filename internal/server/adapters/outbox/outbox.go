@@ -0,0 +1,219 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/pkg/kakafka"
+)
+
+// fields of outbox entry, the same are written by cache along with assigning sequence number of room message
+const (
+	fieldKey   = "key"
+	fieldValue = "value"
+)
+
+// fields added to entry moved to dead stream: its ID in outbox and the error
+const (
+	fieldEntry = "entry"
+	fieldError = "error"
+)
+
+// errMalformedEntry entry misses event value
+var errMalformedEntry = errors.New("outbox entry has no value")
+
+// Outbox passes events to Kafka through Redis stream shared by server instances. Room message is written to the
+// stream by the same script which assigns its sequence number, so events of the room are in the stream in sequence
+// order. Single instance holding the lease relays the stream to Kafka in that order
+type Outbox struct {
+	client *redis.Client
+	writer *kafka.Writer
+	stream string
+	lock   string
+	dead   string
+	lease  time.Duration
+	batch  int64
+	log    zerolog.Logger
+}
+
+func New(client *redis.Client, cfg config.OutboxCfg, kafkaCfg config.KafkaCfg, log zerolog.Logger) *Outbox {
+	return &Outbox{
+		client: client,
+		writer: kakafka.NewSyncWriter(kafkaCfg.Addr, kafkaCfg.Topic),
+		stream: cfg.Stream,
+		lock:   cfg.Stream + ":relay",
+		dead:   cfg.Stream + ":dead",
+		lease:  cfg.Lease,
+		batch:  int64(kafkaCfg.BatchSize),
+		log:    log,
+	}
+}
+
+// Write appends event keyed by room (or pair of users for direct messages) to the stream
+func (o *Outbox) Write(ctx context.Context, key string, data []byte) error {
+	return o.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: o.stream,
+		Values: []string{fieldKey, key, fieldValue, string(data)},
+	}).Err()
+}
+
+// renewScript prolongs the lease and removes relayed entries unless the lease was taken by another instance.
+// KEYS[1] lease, KEYS[2] stream, ARGV: token, lease in milliseconds, IDs of relayed entries
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+if #ARGV > 2 then
+	redis.call('XDEL', KEYS[2], unpack(ARGV, 3))
+end
+return 1
+`)
+
+// Relay competes for the lease until ctx is done and relays the stream while holding it. Entry is removed only after
+// Kafka acknowledged it, so it's written again if the instance fails in between, storage service skips duplicates
+func (o *Outbox) Relay(ctx context.Context) error {
+	defer func() {
+		if err := o.writer.Close(); err != nil {
+			o.log.Error().Err(err).Msg("failed to close outbox writer")
+		}
+	}()
+
+	token := uuid.NewString()
+	for {
+		acquired, err := o.client.SetNX(ctx, o.lock, token, o.lease).Result()
+		if err != nil && ctx.Err() == nil {
+			o.log.Error().Err(err).Msg("failed to acquire outbox lease")
+		}
+		if acquired {
+			o.log.Info().Msg("relaying outbox")
+			o.relay(ctx, token)
+			o.log.Info().Msg("outbox lease is released")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(o.lease / 3):
+		}
+	}
+}
+
+// relay writes entries of the stream to Kafka in batches until lease is lost. Each step takes less than the lease:
+// stream is awaited for a third of it and Kafka write is limited by a half
+func (o *Outbox) relay(ctx context.Context, token string) {
+	last := "0-0"
+	for {
+		entries, err := o.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{o.stream, last},
+			Count:   o.batch,
+			Block:   o.lease / 3,
+		}).Result()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			o.log.Error().Err(err).Msg("failed to read outbox")
+		}
+
+		var relayed []any
+		if len(entries) != 0 && len(entries[0].Messages) != 0 {
+			messages := entries[0].Messages
+			if err = o.write(ctx, messages); err != nil {
+				o.log.Error().Err(err).Msg("failed to relay outbox batch to kafka")
+				// entries are written one by one to find the failing one, the rest is read again from position
+				// of the first entry which failed temporarily
+				messages = o.writeEach(ctx, messages)
+			}
+			if len(messages) != 0 {
+				last = messages[len(messages)-1].ID
+			}
+			for _, m := range messages {
+				relayed = append(relayed, m.ID)
+			}
+		}
+
+		args := append([]any{token, o.lease.Milliseconds()}, relayed...)
+		held, err := renewScript.Run(ctx, o.client, []string{o.lock, o.stream}, args...).Bool()
+		if err != nil {
+			o.log.Error().Err(err).Msg("failed to renew outbox lease")
+		}
+		if !held {
+			return
+		}
+	}
+}
+
+// writeEach writes entries to Kafka in order until one of them fails temporarily. Entries which can never be written
+// are moved to dead stream. Returns handled entries, they are removed from the stream
+func (o *Outbox) writeEach(ctx context.Context, messages []redis.XMessage) []redis.XMessage {
+	for i, m := range messages {
+		err := o.write(ctx, messages[i:i+1])
+		if err == nil {
+			continue
+		}
+		if !permanent(err) {
+			o.log.Error().Err(err).Str("entry", m.ID).Msg("failed to relay outbox entry to kafka")
+			return messages[:i]
+		}
+		if err = o.moveAside(ctx, m, err); err != nil {
+			o.log.Error().Err(err).Str("entry", m.ID).Msg("failed to move outbox entry to dead stream")
+			return messages[:i]
+		}
+		o.log.Error().Str("entry", m.ID).Str("dead_stream", o.dead).Msg("outbox entry can't be relayed, moved to dead stream")
+	}
+	return messages
+}
+
+// moveAside copies entry with the error to dead stream, the entry itself is removed along with relayed ones
+func (o *Outbox) moveAside(ctx context.Context, m redis.XMessage, cause error) error {
+	values := make([]any, 0, len(m.Values)*2+4)
+	for field, value := range m.Values {
+		values = append(values, field, value)
+	}
+	values = append(values, fieldEntry, m.ID, fieldError, cause.Error())
+	return o.client.XAdd(ctx, &redis.XAddArgs{Stream: o.dead, Values: values}).Err()
+}
+
+func (o *Outbox) write(ctx context.Context, messages []redis.XMessage) error {
+	records := make([]kafka.Message, 0, len(messages))
+	for _, m := range messages {
+		key, _ := m.Values[fieldKey].(string)
+		value, ok := m.Values[fieldValue].(string)
+		if !ok || value == "" {
+			return errMalformedEntry
+		}
+		records = append(records, kafka.Message{Key: []byte(key), Value: []byte(value)})
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, o.lease/2)
+	defer cancel()
+	return o.writer.WriteMessages(writeCtx, records...)
+}
+
+// permanent reports whether writing the entry fails regardless of retries
+func permanent(err error) bool {
+	if errors.Is(err, errMalformedEntry) {
+		return true
+	}
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return true
+	}
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) {
+		for _, e := range writeErrs {
+			if e != nil && !permanent(e) {
+				return false
+			}
+		}
+		return writeErrs.Count() != 0
+	}
+	return errors.Is(err, kafka.MessageSizeTooLarge) || errors.Is(err, kafka.InvalidRecord)
+}
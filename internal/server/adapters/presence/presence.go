@@ -0,0 +1,267 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	// roomPrefix hash of user ID to number of connections present in the room
+	roomPrefix = "presence:room:"
+	// userPrefix hash of room to number of connections of the user present in it
+	userPrefix = "presence:user:"
+	// nodePrefix hash of "<user ID>|<room>" to number of connections held by server instance
+	nodePrefix = "presence:node:"
+	// alivePrefix key which exists while server instance renews its lease
+	alivePrefix = "presence:alive:"
+	onlineKey   = "presence:online"
+	namesKey    = "presence:names"
+	nodesKey    = "presence:nodes"
+)
+
+// Presence tracks connections of all server instances in Redis, so presence notices, roster and online users cover
+// the whole cluster. Connections of instance which stopped renewing its lease are dropped by the other instances
+type Presence struct {
+	client *redis.Client
+	node   string
+	lease  time.Duration
+	log    zerolog.Logger
+}
+
+func New(client *redis.Client, cfg config.PresenceCfg, log zerolog.Logger) *Presence {
+	return &Presence{
+		client: client,
+		node:   uuid.NewString(),
+		lease:  cfg.Lease,
+		log:    log,
+	}
+}
+
+// joinScript counts connection of the user in the room, returning 1 if it's the first one in the cluster.
+// KEYS: room hash, user hash, online hash, names hash, node hash, nodes set, alive key.
+// ARGV: user ID, room, username, node field, node, lease in milliseconds
+var joinScript = redis.NewScript(`
+local count = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('HINCRBY', KEYS[2], ARGV[2], 1)
+redis.call('HINCRBY', KEYS[3], ARGV[1], 1)
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[3])
+redis.call('HINCRBY', KEYS[5], ARGV[4], 1)
+redis.call('SADD', KEYS[6], ARGV[5])
+redis.call('SET', KEYS[7], 1, 'PX', ARGV[6])
+if count == 1 then
+	return 1
+end
+return 0
+`)
+
+// leaveScript removes connections of the user from the room, returning username if the last one in the cluster left.
+// KEYS: room hash, user hash, online hash, names hash, node hash. ARGV: user ID, room, node field, number of connections
+var leaveScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return false
+end
+local function decr(key, field)
+	local count = redis.call('HINCRBY', key, field, -tonumber(ARGV[4]))
+	if count <= 0 then
+		redis.call('HDEL', key, field)
+	end
+	return count
+end
+local left = decr(KEYS[1], ARGV[1]) <= 0
+decr(KEYS[2], ARGV[2])
+decr(KEYS[5], ARGV[3])
+local username = redis.call('HGET', KEYS[4], ARGV[1]) or ''
+if decr(KEYS[3], ARGV[1]) <= 0 then
+	redis.call('HDEL', KEYS[4], ARGV[1])
+end
+if left then
+	return username
+end
+return false
+`)
+
+// takeScript removes connections of server instance whose lease expired, returning them.
+// KEYS: nodes set, node hash, alive key. ARGV: node
+var takeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return {}
+end
+local fields = redis.call('HGETALL', KEYS[2])
+redis.call('DEL', KEYS[2])
+redis.call('SREM', KEYS[1], ARGV[1])
+return fields
+`)
+
+// Join registers connection of the user in the room, reporting whether user wasn't present in the room before
+func (p *Presence) Join(ctx context.Context, room string, user response.Member) (bool, error) {
+	userID := strconv.Itoa(user.UserID)
+	keys := []string{roomPrefix + room, userPrefix + userID, onlineKey, namesKey, nodePrefix + p.node, nodesKey,
+		alivePrefix + p.node}
+	first, err := joinScript.Run(ctx, p.client, keys, userID, room, user.Username, nodeField(userID, room), p.node,
+		p.lease.Milliseconds()).Int()
+	return first == 1, err
+}
+
+// Leave unregisters connection of the user in the room, reporting whether it was the last one of the user there
+func (p *Presence) Leave(ctx context.Context, room string, userID int) (bool, error) {
+	_, left, err := p.leave(ctx, p.node, strconv.Itoa(userID), room, 1)
+	return left, err
+}
+
+func (p *Presence) leave(ctx context.Context, node, userID, room string, count int64) (string, bool, error) {
+	keys := []string{roomPrefix + room, userPrefix + userID, onlineKey, namesKey, nodePrefix + node}
+	username, err := leaveScript.Run(ctx, p.client, keys, userID, room, nodeField(userID, room), count).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	return username, err == nil, err
+}
+
+// Roster returns users present in the room, each user is listed once regardless of number of connections
+func (p *Presence) Roster(ctx context.Context, room string) ([]response.Member, error) {
+	ids, err := p.client.HKeys(ctx, roomPrefix+room).Result()
+	if err != nil || len(ids) == 0 {
+		return []response.Member{}, err
+	}
+	names, err := p.client.HMGet(ctx, namesKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]response.Member, 0, len(ids))
+	for i, id := range ids {
+		userID, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		username, _ := names[i].(string)
+		members = append(members, response.Member{UserID: userID, Username: username})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	return members, nil
+}
+
+// Online returns connected users with rooms they are present in
+func (p *Presence) Online(ctx context.Context) ([]response.OnlineUser, error) {
+	conns, err := p.client.HGetAll(ctx, onlineKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := p.client.Pipeline()
+	ids := make([]string, 0, len(conns))
+	rooms := make([]*redis.StringSliceCmd, 0, len(conns))
+	names := make([]*redis.StringCmd, 0, len(conns))
+	for id := range conns {
+		ids = append(ids, id)
+		rooms = append(rooms, pipe.HKeys(ctx, userPrefix+id))
+		names = append(names, pipe.HGet(ctx, namesKey, id))
+	}
+	if len(ids) != 0 {
+		if _, err = pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+
+	online := make([]response.OnlineUser, 0, len(ids))
+	for i, id := range ids {
+		userID, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		connections, _ := strconv.Atoi(conns[id])
+		userRooms := rooms[i].Val()
+		sort.Strings(userRooms)
+		online = append(online, response.OnlineUser{
+			UserID:      userID,
+			Username:    names[i].Val(),
+			Rooms:       userRooms,
+			Connections: connections,
+		})
+	}
+	sort.Slice(online, func(i, j int) bool {
+		return online[i].Username < online[j].Username
+	})
+	return online, nil
+}
+
+// Watch renews lease of the instance and drops connections of instances which stopped renewing theirs, their users
+// are reported to have left. It runs until ctx is done (supposed to be called only once)
+func (p *Presence) Watch(ctx context.Context, broadcast chan<- response.Broadcast) {
+	ticker := time.NewTicker(p.lease / 3)
+	defer ticker.Stop()
+	for {
+		if err := p.client.Set(ctx, alivePrefix+p.node, 1, p.lease).Err(); err != nil && ctx.Err() == nil {
+			p.log.Error().Err(err).Msg("failed to renew presence lease")
+		}
+		p.sweep(ctx, broadcast)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep drops connections of instances whose lease expired
+func (p *Presence) sweep(ctx context.Context, broadcast chan<- response.Broadcast) {
+	nodes, err := p.client.SMembers(ctx, nodesKey).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			p.log.Error().Err(err).Msg("failed to list presence nodes")
+		}
+		return
+	}
+
+	for _, node := range nodes {
+		if node == p.node {
+			continue
+		}
+		fields, err := takeScript.Run(ctx, p.client, []string{nodesKey, nodePrefix + node, alivePrefix + node}, node).StringSlice()
+		if err != nil {
+			p.log.Error().Err(err).Str("node", node).Msg("failed to take connections of expired node")
+			continue
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			userID, room, _ := strings.Cut(fields[i], "|")
+			count, _ := strconv.ParseInt(fields[i+1], 10, 64)
+			username, left, err := p.leave(ctx, node, userID, room, count)
+			if err != nil {
+				p.log.Error().Err(err).Str("node", node).Msg("failed to drop connections of expired node")
+				continue
+			}
+			if !left {
+				continue
+			}
+			id, _ := strconv.Atoi(userID)
+			if b, err := response.NewPresence(response.PresenceLeft, room, response.Member{UserID: id, Username: username}); err == nil {
+				select {
+				case <-ctx.Done():
+					return
+				case broadcast <- b:
+				}
+			}
+		}
+		if len(fields) != 0 {
+			p.log.Warn().Str("node", node).Int("connections", len(fields)/2).Msg("dropped presence of expired node")
+		}
+	}
+}
+
+// nodeField identifies connections of the user in the room within node hash, user ID never contains separator
+func nodeField(userID, room string) string {
+	return userID + "|" + room
+}
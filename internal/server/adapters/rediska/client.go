@@ -3,7 +3,9 @@ package rediska
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/vlasashk/websocket-chat/config"
@@ -12,9 +14,14 @@ import (
 )
 
 type Rediska struct {
-	Client     *redis.Client
-	MaxRecords int64
-	HeadSize   int64
+	Client       *redis.Client
+	MaxRecords   int64
+	HeadSize     int64
+	ReactionsTTL time.Duration
+	// IdempotencyTTL how long resent message is recognized by its idempotency key
+	IdempotencyTTL time.Duration
+	// Outbox stream room messages are written to along with assigning their sequence numbers
+	Outbox string
 }
 
 func NewClient(cfg config.RedisAddr) (*Rediska, error) {
@@ -25,30 +32,97 @@ func NewClient(cfg config.RedisAddr) (*Rediska, error) {
 	})
 
 	return &Rediska{
-		Client:     client,
-		MaxRecords: cfg.MaxRecords,
-		HeadSize:   cfg.HeadSize,
+		Client:         client,
+		MaxRecords:     cfg.MaxRecords,
+		HeadSize:       cfg.HeadSize,
+		ReactionsTTL:   cfg.ReactionsTTL,
+		IdempotencyTTL: cfg.IdempotencyTTL,
 	}, nil
 }
 
-func (r Rediska) AddMessage(ctx context.Context, data []byte) error {
-	pipe := r.Client.Pipeline()
+const (
+	roomKeyPrefix = "chat:"
+	seqKeyPrefix  = "seq:"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message is not cached")
+	ErrNotAuthor       = errors.New("message belongs to another user")
+	// ErrNoSequence counter of the room is missing (e.g. cache was flushed), it must be seeded with the last used number
+	ErrNoSequence = errors.New("room sequence is not initialized")
+	// ErrNoReactions reactions of the message are not cached (e.g. they expired), they must be seeded from storage
+	ErrNoReactions = errors.New("message reactions are not cached")
+)
 
-	pipe.LPush(ctx, "chat", data)
-	pipe.LTrim(ctx, "chat", 0, r.MaxRecords)
+// addScript assigns message the next sequence number of the room, caches, publishes and writes it to outbox
+// atomically. KEYS[1] room list, KEYS[2] room counter, KEYS[3] outbox stream, ARGV: message, max records, channel,
+// event type
+var addScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return false
+end
+local msg = cjson.decode(ARGV[1])
+msg.seq = redis.call('INCR', KEYS[2])
+local data = cjson.encode(msg)
+redis.call('LPUSH', KEYS[1], data)
+redis.call('LTRIM', KEYS[1], 0, ARGV[2])
+redis.call('PUBLISH', ARGV[3], data)
+redis.call('XADD', KEYS[3], '*', 'key', msg.room, 'value', '{"event":"' .. ARGV[4] .. '","payload":' .. data .. '}')
+return msg.seq
+`)
 
-	_, err := pipe.Exec(ctx)
+// AddMessage assigns room message the next sequence number of its room, caches it, publishes it to the channel and
+// writes its event to outbox in one step, so cache, subscribers and Kafka get messages of the room in sequence order.
+// ErrNoSequence is returned if counter of the room has to be seeded first
+func (r Rediska) AddMessage(ctx context.Context, msg *response.Msg, channel string) error {
+	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
+	keys := []string{roomKey(msg.Room), seqKey(msg.Room), r.Outbox}
+	seq, err := addScript.Run(ctx, r.Client, keys, data, r.MaxRecords, channel, string(response.EventMessage)).Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrNoSequence
+		}
+		return err
+	}
+	msg.Seq = seq
 	return nil
 }
 
-func (r Rediska) GetLastTen(ctx context.Context) ([]response.Msg, error) {
+// pendingScript finds the last sequence number of room messages waiting in outbox.
+// KEYS[1] outbox stream, ARGV[1] room
+var pendingScript = redis.NewScript(`
+local last = 0
+for _, entry in ipairs(redis.call('XRANGE', KEYS[1], '-', '+')) do
+	local fields = entry[2]
+	if fields[1] == 'key' and fields[2] == ARGV[1] then
+		local event = cjson.decode(fields[4])
+		if event.event == 'message' and tonumber(event.payload.seq or 0) > last then
+			last = event.payload.seq
+		end
+	end
+end
+return last
+`)
+
+// PendingSequence returns the last sequence number of the room among messages not yet relayed from outbox to Kafka,
+// zero if there are none
+func (r Rediska) PendingSequence(ctx context.Context, room string) (int64, error) {
+	return pendingScript.Run(ctx, r.Client, []string{r.Outbox}, room).Int64()
+}
+
+// SeedSequence starts counter of the room from the last used sequence number unless it's already started
+func (r Rediska) SeedSequence(ctx context.Context, room string, last int64) error {
+	return r.Client.SetNX(ctx, seqKey(room), last, 0).Err()
+}
+
+func (r Rediska) GetLastTen(ctx context.Context, room string) ([]response.Msg, error) {
 	res := make([]response.Msg, 0, 10)
 
-	data, err := r.Client.LRange(ctx, "chat", 0, r.HeadSize-1).Result()
+	data, err := r.Client.LRange(ctx, roomKey(room), 0, r.HeadSize-1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -63,5 +137,186 @@ func (r Rediska) GetLastTen(ctx context.Context) ([]response.Msg, error) {
 
 	utils.FlipMessageOrder(res)
 
+	if err = r.withReactions(ctx, res); err != nil {
+		return nil, err
+	}
+
 	return res, nil
 }
+
+// GetPage returns up to limit cached messages of the room preceding message with given ID (or the latest ones if
+// it's empty) in sequence order. Short page means that cache doesn't hold older messages, not that there are none
+func (r Rediska) GetPage(ctx context.Context, room, before string, limit int) ([]response.Msg, error) {
+	data, err := r.Client.LRange(ctx, roomKey(room), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// list holds the newest message first, page starts right after the given message
+	res := make([]response.Msg, 0, limit)
+	found := before == ""
+	for _, v := range data {
+		var msg response.Msg
+		if err = json.Unmarshal([]byte(v), &msg); err != nil {
+			return nil, err
+		}
+		if !found {
+			found = msg.ID == before
+			continue
+		}
+		res = append(res, msg)
+		if len(res) == limit {
+			break
+		}
+	}
+
+	utils.FlipMessageOrder(res)
+
+	if err = r.withReactions(ctx, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetSince returns cached messages of the room following the sequence number in sequence order. It reports whether
+// cache reaches back to the sequence number, otherwise older of the following messages are not cached
+func (r Rediska) GetSince(ctx context.Context, room string, after int64) ([]response.Msg, bool, error) {
+	data, err := r.Client.LRange(ctx, roomKey(room), 0, -1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var res []response.Msg
+	var complete bool
+	for _, v := range data {
+		var msg response.Msg
+		if err = json.Unmarshal([]byte(v), &msg); err != nil {
+			return nil, false, err
+		}
+		if msg.Seq <= after {
+			complete = true
+			break
+		}
+		res = append(res, msg)
+	}
+
+	utils.FlipMessageOrder(res)
+
+	if err = r.withReactions(ctx, res); err != nil {
+		return nil, false, err
+	}
+
+	return res, complete, nil
+}
+
+// editScript atomically replaces text of cached message if it belongs to the author.
+// KEYS[1] room list, ARGV: message ID, author ID, new text, edit time
+var editScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+for i, item in ipairs(items) do
+	if string.find(item, ARGV[1], 1, true) then
+		local msg = cjson.decode(item)
+		if msg.message_id == ARGV[1] then
+			if tostring(msg.user_id) ~= ARGV[2] then
+				return {'forbidden'}
+			end
+			msg.text = ARGV[3]
+			msg.edited_at = ARGV[4]
+			local updated = cjson.encode(msg)
+			redis.call('LSET', KEYS[1], i - 1, updated)
+			return {'ok', updated}
+		end
+	end
+end
+return false
+`)
+
+// EditMessage updates cached copy of the message returning edited message. ErrMessageNotFound is returned if
+// message is not cached in the room, ErrNotAuthor if it was sent by another user
+func (r Rediska) EditMessage(ctx context.Context, room string, edit response.MessageEdit) (response.Msg, error) {
+	res, err := editScript.Run(ctx, r.Client, []string{roomKey(room)},
+		edit.MessageID, edit.UserID, edit.Text, edit.EditedAt.Format(time.RFC3339Nano)).StringSlice()
+	return scriptResult(res, err)
+}
+
+// deleteScript atomically removes cached message if it belongs to the user or user is moderator.
+// KEYS[1] room list, ARGV: message ID, user ID, "1" for moderator
+var deleteScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+for i, item in ipairs(items) do
+	if string.find(item, ARGV[1], 1, true) then
+		local msg = cjson.decode(item)
+		if msg.message_id == ARGV[1] then
+			if tostring(msg.user_id) ~= ARGV[2] and ARGV[3] ~= '1' then
+				return {'forbidden'}
+			end
+			-- LREM removes by value, so element is replaced with marker first to remove exactly this position
+			redis.call('LSET', KEYS[1], i - 1, '__deleted__')
+			redis.call('LREM', KEYS[1], 1, '__deleted__')
+			return {'ok', item}
+		end
+	end
+end
+return false
+`)
+
+// DeleteMessage removes message from room cache returning removed message. ErrMessageNotFound is returned if
+// message is not cached in the room, ErrNotAuthor if it was sent by another user and user is not moderator
+func (r Rediska) DeleteMessage(ctx context.Context, room string, del response.MessageDelete) (response.Msg, error) {
+	moderator := "0"
+	if del.Moderator {
+		moderator = "1"
+	}
+	res, err := deleteScript.Run(ctx, r.Client, []string{roomKey(room)}, del.MessageID, del.UserID, moderator).StringSlice()
+	return scriptResult(res, err)
+}
+
+// scriptResult converts reply of message scripts into affected message
+func scriptResult(res []string, err error) (response.Msg, error) {
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return response.Msg{}, ErrMessageNotFound
+		}
+		return response.Msg{}, err
+	}
+	if len(res) != 2 || res[0] != "ok" {
+		return response.Msg{}, ErrNotAuthor
+	}
+
+	var msg response.Msg
+	if err = json.Unmarshal([]byte(res[1]), &msg); err != nil {
+		return response.Msg{}, err
+	}
+	return msg, nil
+}
+
+// findScript looks up cached message by its ID. KEYS[1] room list, ARGV[1] message ID
+var findScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+for _, item in ipairs(items) do
+	if string.find(item, ARGV[1], 1, true) then
+		local msg = cjson.decode(item)
+		if msg.message_id == ARGV[1] then
+			return {'ok', item}
+		end
+	end
+end
+return false
+`)
+
+// FindMessage returns cached message of the room, ErrMessageNotFound is returned if it's not cached
+func (r Rediska) FindMessage(ctx context.Context, room, messageID string) (response.Msg, error) {
+	res, err := findScript.Run(ctx, r.Client, []string{roomKey(room)}, messageID).StringSlice()
+	return scriptResult(res, err)
+}
+
+// roomKey returns redis list key holding recent messages of the room
+func roomKey(room string) string {
+	return roomKeyPrefix + room
+}
+
+// seqKey returns redis key of the last sequence number assigned in the room
+func seqKey(room string) string {
+	return seqKeyPrefix + room
+}
@@ -0,0 +1,91 @@
+package rediska
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	// idempotency keys are chosen by clients, so they are scoped by user
+	idempotencyPrefix = "idem:"
+	// pendingPrefix marks claim of message which is not stored yet
+	pendingPrefix = "pending:"
+)
+
+// claimScript takes the key for message unless it's taken, pending claim given as stale is taken over.
+// KEYS[1] claim, ARGV: message ID, ttl in milliseconds, stale claim value (empty if there is none).
+// Returns empty string if the key is taken, current claim value otherwise
+var claimScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current == false or current == ARGV[3] then
+	redis.call('SET', KEYS[1], 'pending:' .. ARGV[1], 'PX', ARGV[2])
+	return ''
+end
+return current
+`)
+
+// commitScript marks pending claim of the message committed, KEYS[1] claim, ARGV: message ID, ttl in milliseconds
+var commitScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == 'pending:' .. ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+end
+return 0
+`)
+
+// releaseScript drops pending claim of the message, KEYS[1] claim, ARGV: message ID
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == 'pending:' .. ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ClaimMessage takes idempotency key of user's message for the message ID, pending until CommitMessage, for
+// IdempotencyTTL. If the key is already taken, false and its current claim are returned
+func (r Rediska) ClaimMessage(ctx context.Context, userID int, key, messageID string) (response.Claim, bool, error) {
+	return r.claim(ctx, userID, key, messageID, "")
+}
+
+// TakeOverMessage takes pending claim left by message which failed to be stored for the message ID, false is returned
+// if the claim has changed meanwhile
+func (r Rediska) TakeOverMessage(ctx context.Context, userID int, key string, stale response.Claim, messageID string) (bool, error) {
+	if stale.Committed {
+		return false, nil
+	}
+	_, claimed, err := r.claim(ctx, userID, key, messageID, pendingPrefix+stale.MessageID)
+	return claimed, err
+}
+
+func (r Rediska) claim(ctx context.Context, userID int, key, messageID, stale string) (response.Claim, bool, error) {
+	current, err := claimScript.Run(ctx, r.Client, []string{idempotencyKey(userID, key)},
+		messageID, r.IdempotencyTTL.Milliseconds(), stale).Text()
+	if err != nil {
+		return response.Claim{}, false, err
+	}
+	if current == "" {
+		return response.Claim{}, true, nil
+	}
+	pendingID, pending := strings.CutPrefix(current, pendingPrefix)
+	if pending {
+		return response.Claim{MessageID: pendingID}, false, nil
+	}
+	return response.Claim{MessageID: current, Committed: true}, false, nil
+}
+
+// CommitMessage marks claim of stored message committed, so resent message is recognized without looking it up
+func (r Rediska) CommitMessage(ctx context.Context, userID int, key, messageID string) error {
+	return commitScript.Run(ctx, r.Client, []string{idempotencyKey(userID, key)}, messageID, r.IdempotencyTTL.Milliseconds()).Err()
+}
+
+// ReleaseMessage frees pending claim of message which failed to be stored, so it may be resent
+func (r Rediska) ReleaseMessage(ctx context.Context, userID int, key, messageID string) error {
+	return releaseScript.Run(ctx, r.Client, []string{idempotencyKey(userID, key)}, messageID).Err()
+}
+
+func idempotencyKey(userID int, key string) string {
+	return idempotencyPrefix + strconv.Itoa(userID) + ":" + key
+}
@@ -0,0 +1,76 @@
+package rediska
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const rateLimitPrefix = "ratelimit:"
+
+// bucketScript takes token from bucket refilled continuously, redis clock is used so all server instances agree.
+// KEYS[1] bucket hash, ARGV: rate in tokens per second, burst
+var bucketScript = redis.NewScript(`
+local now = redis.call('TIME')
+local ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or ms
+tokens = math.min(burst, tokens + math.max(0, ms - ts) * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ms)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return allowed
+`)
+
+// violationScript counts violation within window and mutes user once count reaches the threshold, further violations
+// extend the mute. Zero threshold or mute disables muting. KEYS[1] violations counter, KEYS[2] mute flag,
+// ARGV: window ms, mute threshold, mute ms
+var violationScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+if tonumber(ARGV[2]) > 0 and tonumber(ARGV[3]) > 0 and count >= tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[2], '1', 'PX', ARGV[3])
+end
+return count
+`)
+
+// Allow takes token from the bucket under key, refilled by rate tokens per second up to burst. Non-positive rate
+// disables the bucket
+func (r Rediska) Allow(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	if rate <= 0 {
+		return true, nil
+	}
+	allowed, err := bucketScript.Run(ctx, r.Client, []string{rateLimitPrefix + "bucket:" + key},
+		strconv.FormatFloat(rate, 'f', -1, 64), burst).Int()
+	return allowed == 1, err
+}
+
+// Violate records rate limit violation of the user returning number of violations within window.
+// User is muted for mute once it reaches muteAfter
+func (r Rediska) Violate(ctx context.Context, userID int, window time.Duration, muteAfter int, mute time.Duration) (int, error) {
+	id := strconv.Itoa(userID)
+	return violationScript.Run(ctx, r.Client,
+		[]string{rateLimitPrefix + "violations:" + id, rateLimitPrefix + "mute:" + id},
+		window.Milliseconds(), muteAfter, mute.Milliseconds()).Int()
+}
+
+// MutedFor returns remaining mute of the user, zero if user isn't muted
+func (r Rediska) MutedFor(ctx context.Context, userID int) (time.Duration, error) {
+	ttl, err := r.Client.PTTL(ctx, rateLimitPrefix+"mute:"+strconv.Itoa(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// negative TTL means there is no mute
+	return max(ttl, 0), nil
+}
@@ -0,0 +1,143 @@
+package rediska
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	// reaction keys don't share prefix with room lists, since room names are arbitrary
+	reactionCountsPrefix = "reactions:"
+	reactorsPrefix       = "reactors:"
+)
+
+// seededMember marks reactors set seeded from storage, so set of message without reactions exists as well
+const seededMember = "seeded"
+
+// reactScript adds or removes user's reaction, counting each user once per emoji. Keys expire unless message gets
+// new reactions, so reactions of messages evicted from room lists don't pile up. Missing keys have to be seeded first.
+// KEYS[1] counts hash, KEYS[2] reactors set, ARGV: emoji, user ID, "1" for removal, ttl in seconds
+var reactScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return false
+end
+local member = ARGV[1] .. '|' .. ARGV[2]
+local changed
+if ARGV[3] == '1' then
+	changed = redis.call('SREM', KEYS[2], member)
+else
+	changed = redis.call('SADD', KEYS[2], member)
+end
+local count
+if changed == 1 then
+	local delta = 1
+	if ARGV[3] == '1' then
+		delta = -1
+	end
+	count = redis.call('HINCRBY', KEYS[1], ARGV[1], delta)
+	if count <= 0 then
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		count = 0
+	end
+else
+	count = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+end
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+return {changed, count}
+`)
+
+// React applies reaction to message returning current count of the emoji and whether reaction was changed
+// (repeated add or removal of absent reaction changes nothing). ErrNoReactions is returned if reactions of the
+// message have to be seeded first
+func (r Rediska) React(ctx context.Context, reaction response.MessageReaction) (int, bool, error) {
+	remove := "0"
+	if reaction.Remove {
+		remove = "1"
+	}
+	res, err := reactScript.Run(ctx, r.Client,
+		[]string{reactionCountsPrefix + reaction.MessageID, reactorsPrefix + reaction.MessageID},
+		reaction.Emoji, reaction.UserID, remove, int64(r.ReactionsTTL.Seconds())).Int64Slice()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, false, ErrNoReactions
+		}
+		return 0, false, err
+	}
+	return int(res[1]), res[0] == 1, nil
+}
+
+// seedScript fills reactors and counts of the message unless they are cached.
+// KEYS[1] counts hash, KEYS[2] reactors set, ARGV: ttl in seconds, seeded marker, emoji and user ID pairs
+var seedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('SADD', KEYS[2], ARGV[2])
+for i = 3, #ARGV, 2 do
+	if redis.call('SADD', KEYS[2], ARGV[i] .. '|' .. ARGV[i + 1]) == 1 then
+		redis.call('HINCRBY', KEYS[1], ARGV[i], 1)
+	end
+end
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[2], ARGV[1])
+return 1
+`)
+
+// SeedReactions caches stored reactions of the message unless its reactions are already cached
+func (r Rediska) SeedReactions(ctx context.Context, messageID string, reactions []response.MessageReaction) error {
+	args := make([]any, 0, 2+2*len(reactions))
+	args = append(args, int64(r.ReactionsTTL.Seconds()), seededMember)
+	for _, reaction := range reactions {
+		args = append(args, reaction.Emoji, reaction.UserID)
+	}
+	return seedScript.Run(ctx, r.Client, []string{reactionCountsPrefix + messageID, reactorsPrefix + messageID},
+		args...).Err()
+}
+
+// FillReactions attaches cached reaction counts to messages which were not read from cache. Counts read from storage
+// are kept for messages whose reactions are not cached
+func (r Rediska) FillReactions(ctx context.Context, messages []response.Msg) error {
+	return r.withReactions(ctx, messages)
+}
+
+// withReactions replaces reaction counts of messages whose reactions are cached
+func (r Rediska) withReactions(ctx context.Context, messages []response.Msg) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	pipe := r.Client.Pipeline()
+	counts := make([]*redis.MapStringStringCmd, len(messages))
+	cached := make([]*redis.IntCmd, len(messages))
+	for i, msg := range messages {
+		counts[i] = pipe.HGetAll(ctx, reactionCountsPrefix+msg.ID)
+		cached[i] = pipe.Exists(ctx, reactorsPrefix+msg.ID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	for i, cmd := range counts {
+		if cached[i].Val() == 0 {
+			continue
+		}
+		messages[i].Reactions = nil
+		for emoji, raw := range cmd.Val() {
+			count, err := strconv.Atoi(raw)
+			if err != nil || count <= 0 {
+				continue
+			}
+			if messages[i].Reactions == nil {
+				messages[i].Reactions = make(map[string]int)
+			}
+			messages[i].Reactions[emoji] = count
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import "expvar"
+
+// Spoof kinds of identity fields client tried to forge
+const (
+	SpoofUserID   = "user_id"
+	SpoofUsername = "username"
+)
+
+// SpoofAttempts counts messages carrying identity different from the one bound to connection, keyed by forged field
+var SpoofAttempts = expvar.NewMap("spoof_attempts")
+
+// Limit kinds of rejected requests
+const (
+	LimitMessage    = "message"
+	LimitControl    = "control"
+	LimitConnection = "connection"
+)
+
+// RateLimited counts frames and connections rejected by rate limits, keyed by limit kind
+var RateLimited = expvar.NewMap("rate_limited")
@@ -1,29 +1,42 @@
 package httpchi
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/go-chi/render"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
-	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/directory"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/rediska"
+	"github.com/vlasashk/websocket-chat/internal/server/metrics"
 	"github.com/vlasashk/websocket-chat/internal/server/resources"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
 	"github.com/vlasashk/websocket-chat/pkg/listener"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(_ *http.Request) bool {
-		return true
-	},
-}
+var (
+	errServiceToken = errors.New("service token can't open chat session")
+	// errDuplicateMessage message with the same idempotency key was already sent by the user
+	errDuplicateMessage = errors.New("message is already sent")
+)
+
+// maxIdempotencyKeyLen limit of client chosen idempotency key, UUID fits it in any notation
+const maxIdempotencyKeyLen = 64
+
+// maxTextLen limit of message text in runes, keeps events written to Kafka well below its record size limit
+const maxTextLen = 4000
+
+// maxFrameSize limit of frame read from client in bytes, connection sending larger one is closed
+const maxFrameSize = 64 << 10
 
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, render.M{
@@ -31,10 +44,68 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func EstablishWS(ctx context.Context, container *resources.Resources) http.HandlerFunc {
-	broadcast := container.ClientManager.Broadcaster(ctx)
+// EstablishWS upgrades authenticated request to WS chat session. Broadcasts of sessions are shared with other server
+// instances via fanout
+func EstablishWS(ctx context.Context, container *resources.Resources) (http.HandlerFunc, error) {
+	proxies, err := parseProxies(container.Cfg.RateLimit.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := container.Fanout.Relay(ctx, container.ClientManager.Broadcaster(ctx))
+	if err != nil {
+		return nil, err
+	}
+	go container.Presence.Watch(ctx, broadcast)
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: container.Cfg.Conn.HandshakeTimeout,
+		CheckOrigin:      checkOrigin(container.Cfg.Server.AllowedOrigins),
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		log := container.Log.With().Caller().Logger()
+		limits := container.Cfg.RateLimit
+		ip := remoteIP(r, proxies)
+
+		if !allow(r.Context(), log, container.Limiter, "conn:ip:"+ip, limits.IPConnRate, limits.IPConnBurst) {
+			metrics.RateLimited.Add(metrics.LimitConnection, 1)
+			render.Status(r, http.StatusTooManyRequests)
+			render.JSON(w, r, response.ErrResp{Error: "too many connections"})
+			return
+		}
+
+		claims, ok := authorize(w, r, container)
+		if !ok {
+			return
+		}
+		if claims.Service {
+			// service token has no user to chat on behalf of
+			log.Warn().Err(errServiceToken).Str("remote_addr", r.RemoteAddr).Msg("unauthorized WS upgrade")
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, response.ErrResp{Error: "unauthorized"})
+			return
+		}
+
+		if !allow(r.Context(), log, container.Limiter, "conn:user:"+strconv.Itoa(claims.UserID), limits.UserConnRate, limits.UserConnBurst) {
+			metrics.RateLimited.Add(metrics.LimitConnection, 1)
+			render.Status(r, http.StatusTooManyRequests)
+			render.JSON(w, r, response.ErrResp{Error: "too many connections"})
+			return
+		}
+
+		room := r.URL.Query().Get("room")
+		if room == "" {
+			room = container.Cfg.Server.DefaultRoom
+		}
+		if !validName(room) {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "room name length is not supported"})
+			return
+		}
+		resume, err := parseResumePoint(r)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: err.Error()})
+			return
+		}
 
 		con, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -42,136 +113,351 @@ func EstablishWS(ctx context.Context, container *resources.Resources) http.Handl
 			return
 		}
 		// Doesn't run in goroutine to be able to catch panic by chi router
-		reader(ctx, con, container, broadcast)
+		reader(ctx, con, container, broadcast, room, ip, claims, resume)
+	}, nil
+}
+
+// OnlineUsers lists users connected to any server instance, it requires session token same as WS upgrade
+func OnlineUsers(container *resources.Resources) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorize(w, r, container); !ok {
+			return
+		}
+		online, err := container.Presence.Online(r.Context())
+		if err != nil {
+			container.Log.Error().Err(err).Msg("failed to get online users")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get online users"})
+			return
+		}
+		render.JSON(w, r, online)
 	}
 }
 
-func reader(ctx context.Context, con *websocket.Conn, container *resources.Resources, broadcast chan<- response.Msg) {
+// reader serves WS session of the user. Session with resume point replays missed messages instead of recent ones,
+// live frames are held until the replay is done
+func reader(ctx context.Context, con *websocket.Conn, container *resources.Resources, broadcast chan<- response.Broadcast, room, ip string, claims auth.Claims, resume resumePoint) {
 	cm := container.ClientManager
 	log := container.Log
-	cache := container.RedisRepo
-	kafkaWriter := container.KafkaWriter
+	connCfg := container.Cfg.Conn
 
-	cm.Store(con)
+	// connCtx stops connection helpers once reader exits
+	connCtx, cancel := context.WithCancel(ctx)
+	user := response.User{UserID: claims.UserID, Username: claims.Username}
+	if resume.set() {
+		cm.StoreHeld(con, room, user)
+	} else {
+		cm.Store(con, room, user)
+	}
+	sess := &session{
+		con:       con,
+		remoteIP:  ip,
+		container: container,
+		broadcast: broadcast,
+		userID:    claims.UserID,
+		username:  claims.Username,
+		room:      room,
+	}
+	sess.enter(ctx)
 	defer func() {
+		// others must not see user typing after disconnect
+		sess.stopTyping(ctx)
+		cancel()
 		cm.Release(con)
+		sess.exit(ctx)
 		log.Info().Msg("connection released")
 	}()
-	// Listens for first message from client that will indicate client's nickname
-	userID, err := registerUser(ctx, con, container.Cfg.Storage)
-	if err != nil {
-		log.Error().Err(err).Send()
+
+	// read side is set up before reader starts, heartbeat only writes pings
+	con.SetReadLimit(maxFrameSize)
+	if err := listener.ExpectPongs(con, connCfg.Heartbeat); err != nil {
+		log.Error().Err(err).Msg("failed to set read deadline")
 		return
 	}
-	// Sends to client recent messages from chat (up to 10 messages)
-	outputRecent(ctx, log, cache, con, cm)
-	listen := listener.SocketListen(ctx, log, con)
+	go func() {
+		if err := listener.Heartbeat(connCtx, log, con, connCfg.Heartbeat); err != nil {
+			log.Error().Err(err).Msg("heartbeat stopped")
+		}
+	}()
+
+	// Greets client with identity taken from its token
+	sess.hello()
+	if resume.set() {
+		sess.resume(ctx, resume)
+	} else {
+		// Sends to client recent messages from chat room (up to 10 messages)
+		sess.outputRecent(ctx)
+	}
+	listen := listener.SocketListen(connCtx, log, con)
+	// idle evicts connection which sends nothing but pongs
+	idle := time.NewTimer(connCfg.IdleTimeout)
+	defer idle.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			log.Info().Msg("context was canceled")
 			return
+		case <-idle.C:
+			log.Info().Int("user_id", claims.UserID).Msg("idle connection evicted")
+			listener.SendClose(log, con, listener.IdleCloseCode, listener.IdleCloseReason)
+			return
 		case data, ok := <-listen:
-
 			if !ok {
 				log.Error().Msg("connection died unexpectedly")
 				return
 			}
-
-			var msg response.Msg
-			if err = json.Unmarshal(data, &msg); err != nil {
-				log.Error().Err(err).Msg("failed to unmarshal msg")
-				continue
+			idle.Reset(connCfg.IdleTimeout)
+			if err := sess.handle(ctx, data); err != nil {
+				listener.SendClose(log, con, websocket.ClosePolicyViolation, err.Error())
+				return
 			}
-			msg.UserID = userID
+		}
+	}
+}
 
-			if err = storeMessage(ctx, log, cache, kafkaWriter, msg); err != nil {
-				log.Error().Err(err).Send()
-				continue
-			}
-			msg.Print()
-
-			go func() {
-				select {
-				case <-ctx.Done():
-					return
-				case broadcast <- msg:
-					return
-				}
-			}()
+// authorize authenticates request by token which isn't revoked, otherwise error is rendered
+func authorize(w http.ResponseWriter, r *http.Request, container *resources.Resources) (auth.Claims, bool) {
+	claims, err := authenticate(r, container.Auth)
+	if err == nil {
+		err = checkRevoked(r.Context(), container.Users, claims)
+		if err != nil && !errors.Is(err, auth.ErrTokenRevoked) {
+			container.Log.Error().Err(err).Msg("failed to check token version")
+			render.Status(r, http.StatusServiceUnavailable)
+			render.JSON(w, r, response.ErrResp{Error: "failed to verify token"})
+			return auth.Claims{}, false
 		}
 	}
+	if err != nil {
+		container.Log.Warn().Err(err).Str("remote_addr", r.RemoteAddr).Msg("unauthorized request")
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, response.ErrResp{Error: "unauthorized"})
+		return auth.Claims{}, false
+	}
+	return claims, true
+}
+
+// checkRevoked reports auth.ErrTokenRevoked if password of token owner was changed after the token was issued or
+// the account is missing
+func checkRevoked(ctx context.Context, users resources.UserDirectory, claims auth.Claims) error {
+	if claims.Service {
+		return nil
+	}
+	user, err := users.UserByID(ctx, claims.UserID)
+	if errors.Is(err, directory.ErrNotFound) {
+		return auth.ErrTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+	return claims.CheckVersion(user.TokenVersion)
 }
 
-func registerUser(ctx context.Context, con *websocket.Conn, addr config.StorageAddr) (int, error) {
-	mt, username, err := con.ReadMessage()
-	if err != nil || mt == websocket.CloseMessage {
-		return 0, err
+// authenticate validates session token passed in Authorization header or token query parameter
+func authenticate(r *http.Request, verifier resources.TokenVerifier) (auth.Claims, error) {
+	token, err := auth.FromRequest(r)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	return verifier.Parse(token)
+}
+
+// checkOrigin builds origin policy for WS upgrade. Empty list falls back to same origin policy of gorilla
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return nil
 	}
 
-	length := utf8.RuneCountInString(string(username))
-	if length == 0 || length > 50 {
-		return 0, errors.New("username length is not supported")
+	origins := make(map[string]struct{}, len(allowed))
+	for _, origin := range allowed {
+		origins[strings.TrimSpace(origin)] = struct{}{}
+	}
+	if _, ok := origins["*"]; ok {
+		return func(_ *http.Request) bool {
+			return true
+		}
 	}
 
-	return sendRegisterRequest(ctx, addr, string(username))
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// non browser clients don't send origin
+			return true
+		}
+		_, ok := origins[origin]
+		return ok
+	}
 }
 
-func sendRegisterRequest(ctx context.Context, addr config.StorageAddr, username string) (int, error) {
-	requestBody, err := json.Marshal(response.RegisterReq{Username: username})
+// storeMessage assigns message its unique time-ordered ID and timestamp, then writes it to cache and outbox relayed
+// to kafka. Room message gets its sequence number in cache, which also publishes it to all server instances.
+// Direct messages are kept out of shared room cache. Message resent with idempotency key of already stored one
+// is rejected with errDuplicateMessage, message without key gets its ID as the key
+func storeMessage(ctx context.Context, container *resources.Resources, msg *response.Msg) (err error) {
+	log := container.Log
+
+	id, err := uuid.NewV7()
 	if err != nil {
-		return 0, err
+		return err
 	}
+	msg.ID = id.String()
+	msg.SentAt = time.Now().UTC()
 
-	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s:%s/register", addr.Host, addr.Port), bytes.NewBuffer(requestBody))
-	if err != nil {
-		return 0, err
+	if msg.IdempotencyKey == "" {
+		msg.IdempotencyKey = msg.ID
+	} else {
+		if err = claimKey(ctx, container, *msg); err != nil {
+			return err
+		}
+		// claim is settled even if session is closed meanwhile
+		defer func() {
+			settleCtx := context.WithoutCancel(ctx)
+			if err == nil {
+				err = container.RedisRepo.CommitMessage(settleCtx, msg.UserID, msg.IdempotencyKey, msg.ID)
+				if err != nil {
+					// message is stored, pending claim is recognized by looking it up
+					log.Error().Err(err).Msg("failed to commit idempotency key")
+					err = nil
+				}
+				return
+			}
+			if releaseErr := container.RedisRepo.ReleaseMessage(settleCtx, msg.UserID, msg.IdempotencyKey, msg.ID); releaseErr != nil {
+				log.Error().Err(releaseErr).Msg("failed to release idempotency key")
+			}
+		}()
+	}
+
+	if msg.RecipientID == 0 {
+		// room message is written to outbox by cache along with its sequence number
+		start := time.Now()
+		if err = addToRoom(ctx, container, msg); err != nil {
+			return err
+		}
+		log.Info().Dur("redis wrtie time", time.Since(start)).Send()
+		return nil
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := (&http.Client{}).Do(req)
+	event, err := response.NewEvent(response.EventMessage, msg)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer resp.Body.Close()
 
-	var userID response.RegisterResp
-	if err = render.DecodeJSON(resp.Body, &userID); err != nil {
-		return 0, err
+	start := time.Now()
+	if err = container.KafkaWriter.Write(ctx, eventKey(*msg), event); err != nil {
+		return err
 	}
+	log.Info().Dur("outbox wrtie time", time.Since(start)).Send()
 
-	return userID.UserID, nil
+	return nil
 }
 
-func outputRecent(ctx context.Context, log zerolog.Logger, repo resources.CacheRepo, con *websocket.Conn, cm resources.ClientManager) {
-	recentMessages, err := repo.GetLastTen(ctx)
+// claimKey takes idempotency key of the message. Key committed by stored message means the message is resent.
+// Pending claim is left by instance which failed while storing the message (or is still storing it), it's taken over
+// unless its message made it to cache or storage
+func claimKey(ctx context.Context, container *resources.Resources, msg response.Msg) error {
+	cache := container.RedisRepo
+	claim, claimed, err := cache.ClaimMessage(ctx, msg.UserID, msg.IdempotencyKey, msg.ID)
+	if err != nil || claimed {
+		return err
+	}
+	if claim.Committed {
+		return errDuplicateMessage
+	}
+
+	stored, err := messageStored(ctx, container, msg.Room, claim.MessageID)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get messages from db")
-		return
+		return err
+	}
+	if stored {
+		return errDuplicateMessage
 	}
+	claimed, err = cache.TakeOverMessage(ctx, msg.UserID, msg.IdempotencyKey, claim, msg.ID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// another resend took it over
+		return errDuplicateMessage
+	}
+	return nil
+}
 
-	for _, msg := range recentMessages {
-		if err := cm.WriteMsg(con, msg); err != nil {
-			log.Error().Err(err).Msg("error on writing")
+// messageStored reports whether message is in cache of the room or in storage
+func messageStored(ctx context.Context, container *resources.Resources, room, messageID string) (bool, error) {
+	if room != "" {
+		_, err := container.RedisRepo.FindMessage(ctx, room, messageID)
+		if err == nil {
+			return true, nil
 		}
+		if !errors.Is(err, rediska.ErrMessageNotFound) {
+			return false, err
+		}
+	}
+	_, err := container.Archive.MessageByID(ctx, messageID)
+	if errors.Is(err, directory.ErrNotFound) {
+		return false, nil
 	}
+	return err == nil, err
 }
 
-func storeMessage(ctx context.Context, log zerolog.Logger, cache resources.CacheRepo, kafkaWriter resources.MessageBroker, msg response.Msg) error {
-	data, err := json.Marshal(msg)
+// addToRoom caches room message assigning it the next sequence number of the room. Missing counter of the room
+// (e.g. after cache flush) is seeded with the last sequence number used either by messages waiting in outbox or by
+// messages known to storage service. Outbox is checked first, message relayed meanwhile is awaited by storage
+func addToRoom(ctx context.Context, container *resources.Resources, msg *response.Msg) error {
+	cache := container.RedisRepo
+	channel := container.Cfg.Fanout.MessageChannel
+
+	err := cache.AddMessage(ctx, msg, channel)
+	if !errors.Is(err, rediska.ErrNoSequence) {
+		return err
+	}
+
+	pending, err := cache.PendingSequence(ctx, msg.Room)
+	if err != nil {
+		return err
+	}
+	stored, err := container.Archive.LastSeq(ctx, msg.Room)
 	if err != nil {
 		return err
 	}
+	if err = cache.SeedSequence(ctx, msg.Room, max(pending, stored)); err != nil {
+		return err
+	}
+	return cache.AddMessage(ctx, msg, channel)
+}
 
-	start := time.Now()
-	kafkaWriter.Write(ctx, data)
-	log.Info().Dur("kafka wrtie time", time.Since(start)).Send()
+// eventKey keys broker events of the message by its room, events of direct message by the pair of its participants
+func eventKey(msg response.Msg) string {
+	if msg.RecipientID == 0 {
+		return msg.Room
+	}
+	low, high := msg.UserID, msg.RecipientID
+	if low > high {
+		low, high = high, low
+	}
+	return "dm:" + strconv.Itoa(low) + ":" + strconv.Itoa(high)
+}
 
-	start = time.Now()
-	if err = cache.AddMessage(ctx, data); err != nil {
-		return err
+func writeEnvelope(log zerolog.Logger, cm resources.ClientManager, con *websocket.Conn, env response.Envelope) {
+	if err := cm.Write(con, env); err != nil {
+		log.Error().Err(err).Msg("error on writing")
 	}
-	log.Info().Dur("redis wrtie time", time.Since(start)).Send()
+}
 
-	return nil
+// validEmoji accepts single reaction token: up to 32 bytes of printable text without spaces
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > 32 || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validName checks length of user and room names
+func validName(name string) bool {
+	length := utf8.RuneCountInString(name)
+	return length > 0 && length <= 50
 }
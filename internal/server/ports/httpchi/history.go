@@ -0,0 +1,92 @@
+package httpchi
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// handleHistory answers with page of current room messages sent before the given one. Page is served from cache
+// while it holds enough messages, otherwise it's completed by messages stored in storage service
+func (s *session) handleHistory(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.HistoryRequest
+	if len(env.Payload) > 0 {
+		if err := env.Decode(&req); err != nil {
+			s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed history payload"))
+			return
+		}
+	}
+	if req.Before != "" {
+		messageID, err := uuid.Parse(req.Before)
+		if err != nil {
+			s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "bad message id"))
+			return
+		}
+		req.Before = messageID.String()
+	}
+	maxLimit := s.container.Cfg.History.PageLimit
+	switch {
+	case req.Limit == 0:
+		req.Limit = int(s.container.Cfg.Redis.HeadSize)
+	case req.Limit < 0 || req.Limit > maxLimit:
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "history limit is not supported"))
+		return
+	}
+
+	messages, err := s.container.RedisRepo.GetPage(ctx, s.room, req.Before, req.Limit)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get cached history page")
+		messages = nil
+	}
+	if len(messages) < req.Limit {
+		stored, err := s.container.Archive.RoomHistory(ctx, s.room, req.Before, req.Limit)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get stored history page")
+			s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to get history"))
+			return
+		}
+		messages = mergePages(messages, stored, req.Limit)
+		if err = s.container.RedisRepo.FillReactions(ctx, messages); err != nil {
+			log.Error().Err(err).Msg("failed to get reactions of history page")
+		}
+	}
+
+	reply, err := response.NewEnvelope(response.TypeHistory, env.ID, response.HistoryPayload{
+		Room:     s.room,
+		Messages: messages,
+		Before:   req.Before,
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.write(reply)
+}
+
+// mergePages joins cached and stored pages keeping the newest limit messages in sequence order. Cached copy
+// wins, since messages reach storage asynchronously and it may miss the latest edits
+func mergePages(cached, stored []response.Msg, limit int) []response.Msg {
+	seen := make(map[string]struct{}, len(cached))
+	merged := make([]response.Msg, 0, len(cached)+len(stored))
+	for _, msg := range cached {
+		seen[msg.ID] = struct{}{}
+		merged = append(merged, msg)
+	}
+	for _, msg := range stored {
+		if _, ok := seen[msg.ID]; !ok {
+			merged = append(merged, msg)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Seq < merged[j].Seq
+	})
+	if len(merged) > limit {
+		merged = merged[len(merged)-limit:]
+	}
+	return merged
+}
@@ -0,0 +1,69 @@
+package httpchi
+
+import (
+	"context"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// enter registers connection in presence of current room, room members are notified if it's the first connection
+// of the user there
+func (s *session) enter(ctx context.Context) {
+	first, err := s.container.Presence.Join(ctx, s.room, s.member())
+	if err != nil {
+		s.container.Log.Error().Err(err).Str("room", s.room).Msg("failed to join presence")
+		return
+	}
+	if first {
+		s.notifyPresence(ctx, response.PresenceJoined)
+	}
+}
+
+// exit unregisters connection from presence of current room, room members are notified if it was the last
+// connection of the user there. Presence is updated even if ctx is already canceled
+func (s *session) exit(ctx context.Context) {
+	last, err := s.container.Presence.Leave(context.WithoutCancel(ctx), s.room, s.userID)
+	if err != nil {
+		s.container.Log.Error().Err(err).Str("room", s.room).Msg("failed to leave presence")
+		return
+	}
+	if last {
+		s.notifyPresence(ctx, response.PresenceLeft)
+	}
+}
+
+// notifyPresence passes presence change of the user in current room to broadcast
+func (s *session) notifyPresence(ctx context.Context, action string) {
+	b, err := response.NewPresence(action, s.room, s.member())
+	if err != nil {
+		s.container.Log.Error().Err(err).Msg("failed to wrap presence")
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case s.broadcast <- b:
+	}
+}
+
+// roster sends to client users present in current room
+func (s *session) roster(ctx context.Context, id string) {
+	users, err := s.container.Presence.Roster(ctx, s.room)
+	if err != nil {
+		s.container.Log.Error().Err(err).Str("room", s.room).Msg("failed to get roster")
+		s.write(response.NewError(id, response.ErrCodeInternal, "failed to get roster"))
+		return
+	}
+	env, err := response.NewEnvelope(response.TypeRoster, id, response.RosterPayload{
+		Room:  s.room,
+		Users: users,
+	})
+	if err != nil {
+		s.container.Log.Error().Err(err).Send()
+		return
+	}
+	s.write(env)
+}
+
+func (s *session) member() response.Member {
+	return response.Member{UserID: s.userID, Username: s.username}
+}
@@ -0,0 +1,160 @@
+package httpchi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/vlasashk/websocket-chat/internal/server/metrics"
+	"github.com/vlasashk/websocket-chat/internal/server/resources"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// limitedTypes frames which store or look up messages, they are counted by message rate limits. Any other frame is
+// counted by cheaper control rate limits
+var limitedTypes = map[response.EnvelopeType]struct{}{
+	response.TypeMessage:  {},
+	response.TypeDirect:   {},
+	response.TypeEdit:     {},
+	response.TypeDelete:   {},
+	response.TypeReaction: {},
+	response.TypeHistory:  {},
+	response.TypeSearch:   {},
+}
+
+// throttle enforces rate limits of the user and remote IP, reporting whether frame may be processed. Control frames
+// take tokens of control buckets and aren't affected by mute. Violation is answered with error frame, repeated
+// violations mute the user and errRateLimited is returned once connection must be dropped. Limiter failures don't
+// block the chat
+func (s *session) throttle(ctx context.Context, id string, control bool) (bool, error) {
+	log := s.container.Log
+	limiter := s.container.Limiter
+	cfg := s.container.Cfg.RateLimit
+
+	kind, userRate, userBurst, ipRate, ipBurst := "msg", cfg.UserMsgRate, cfg.UserMsgBurst, cfg.IPMsgRate, cfg.IPMsgBurst
+	if control {
+		kind, userRate, userBurst, ipRate, ipBurst = "ctl", cfg.UserCtlRate, cfg.UserCtlBurst, cfg.IPCtlRate, cfg.IPCtlBurst
+	}
+
+	var muted time.Duration
+	if !control {
+		var err error
+		if muted, err = limiter.MutedFor(ctx, s.userID); err != nil {
+			log.Error().Err(err).Msg("failed to check mute")
+			return true, nil
+		}
+	}
+	if muted == 0 {
+		allowed := allow(ctx, log, limiter, kind+":user:"+strconv.Itoa(s.userID), userRate, userBurst) &&
+			allow(ctx, log, limiter, kind+":ip:"+s.remoteIP, ipRate, ipBurst)
+		if allowed {
+			return true, nil
+		}
+	}
+
+	if control {
+		metrics.RateLimited.Add(metrics.LimitControl, 1)
+	} else {
+		metrics.RateLimited.Add(metrics.LimitMessage, 1)
+	}
+	violations, err := limiter.Violate(ctx, s.userID, cfg.ViolationWindow, cfg.MuteAfter, cfg.MuteDuration)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to record rate limit violation")
+	}
+	switch {
+	case cfg.DisconnectAfter > 0 && violations >= cfg.DisconnectAfter:
+		log.Warn().Int("user_id", s.userID).Str("remote_ip", s.remoteIP).Int("violations", violations).Msg("rate limit violator disconnected")
+		return false, errRateLimited
+	case control:
+		s.write(response.NewError(id, response.ErrCodeRateLimited, "too many requests, slow down"))
+	case muted > 0 || (cfg.MuteAfter > 0 && cfg.MuteDuration > 0 && violations >= cfg.MuteAfter):
+		s.write(response.NewError(id, response.ErrCodeMuted, "too many messages, muted for "+cfg.MuteDuration.String()))
+	default:
+		s.write(response.NewError(id, response.ErrCodeRateLimited, "too many messages, slow down"))
+	}
+	return false, nil
+}
+
+// allow takes token from the bucket, limiter failure lets request through
+func allow(ctx context.Context, log zerolog.Logger, limiter resources.RateLimiter, key string, rate float64, burst int) bool {
+	allowed, err := limiter.Allow(ctx, key, rate, burst)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("failed to check rate limit")
+		return true
+	}
+	return allowed
+}
+
+// parseProxies converts trusted proxies given as IPs or CIDRs into prefixes
+func parseProxies(proxies []string) ([]netip.Prefix, error) {
+	res := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			res = append(res, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		res = append(res, prefix.Masked())
+	}
+	return res, nil
+}
+
+// remoteIP returns host part of request remote address. Request passed by trusted proxy is attributed to the nearest
+// address in X-Forwarded-For which isn't trusted proxy, addresses further left are set by client and can't be trusted
+func remoteIP(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trusted(host, proxies) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err = netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !trusted(hop, proxies) {
+			break
+		}
+	}
+	return host
+}
+
+// trusted reports whether address belongs to one of trusted proxies
+func trusted(host string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
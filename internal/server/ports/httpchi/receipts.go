@@ -0,0 +1,144 @@
+package httpchi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/directory"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/rediska"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// handleReceipt moves delivery or read marker of the user in current room forward and lets room members know.
+// Message IDs are time ordered, so receipt for message older than already acknowledged one is only acked
+func (s *session) handleReceipt(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.ReceiptPayload
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed receipt payload"))
+		return
+	}
+	if req.Kind != response.ReceiptDelivered && req.Kind != response.ReceiptRead {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "receipt kind must be delivered or read"))
+		return
+	}
+	messageID, err := uuid.Parse(req.MessageID)
+	if err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "bad message id"))
+		return
+	}
+
+	if err = s.inRoom(ctx, messageID.String()); err != nil {
+		s.writeMessageErr(env.ID, "acknowledge", err)
+		return
+	}
+
+	if s.receipts == nil {
+		s.receipts = make(map[string]string)
+	}
+	if messageID.String() <= s.receipts[req.Kind] {
+		s.ack(env.ID)
+		return
+	}
+	s.receipts[req.Kind] = messageID.String()
+
+	event, err := response.NewEvent(response.EventReceipt, response.Receipt{
+		UserID:    s.userID,
+		Room:      s.room,
+		MessageID: messageID.String(),
+		Kind:      req.Kind,
+		At:        time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to acknowledge message"))
+		return
+	}
+	if err = s.container.KafkaWriter.Write(ctx, s.room, event); err != nil {
+		log.Error().Err(err).Msg("failed to write event")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to acknowledge message"))
+		return
+	}
+	s.ack(env.ID)
+
+	notice, err := response.NewEnvelope(response.TypeReceipt, "", response.ReceiptPayload{
+		MessageID: messageID.String(),
+		Kind:      req.Kind,
+		UserID:    s.userID,
+		Username:  s.username,
+		Room:      s.room,
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.broadcastEnvelope(ctx, response.Msg{Room: s.room}, notice)
+}
+
+// handleReadBy answers with users who have read current room up to the message
+func (s *session) handleReadBy(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.ReadByPayload
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed read_by payload"))
+		return
+	}
+	messageID, err := uuid.Parse(req.MessageID)
+	if err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "bad message id"))
+		return
+	}
+
+	if err = s.inRoom(ctx, messageID.String()); err != nil {
+		s.writeMessageErr(env.ID, "look up readers of", err)
+		return
+	}
+
+	users, err := s.container.Archive.ReadBy(ctx, s.room, messageID.String())
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get read markers")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to look up readers of message"))
+		return
+	}
+
+	reply, err := response.NewEnvelope(response.TypeReadBy, env.ID, response.ReadByPayload{
+		MessageID: messageID.String(),
+		Users:     users,
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.write(reply)
+}
+
+// inRoom checks that message was sent to current room, looking it up in cache first and then in storage service
+func (s *session) inRoom(ctx context.Context, messageID string) error {
+	_, err := s.container.RedisRepo.FindMessage(ctx, s.room, messageID)
+	if !errors.Is(err, rediska.ErrMessageNotFound) {
+		return err
+	}
+
+	stored, err := s.container.Archive.MessageByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if stored.Room != s.room {
+		return directory.ErrNotFound
+	}
+	return nil
+}
+
+// readState returns read position of the user in current room, it's left empty if storage service is unavailable
+func (s *session) readState(ctx context.Context) response.ReadState {
+	state, err := s.container.Archive.ReadState(ctx, s.userID, s.room)
+	if err != nil {
+		s.container.Log.Error().Err(err).Msg("failed to get read state")
+		return response.ReadState{Room: s.room}
+	}
+	return state
+}
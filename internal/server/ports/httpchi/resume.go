@@ -0,0 +1,191 @@
+package httpchi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/directory"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/rediska"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+var errBadResumePoint = errors.New("last_seq must be positive number and last_id message ID")
+
+// resumePoint the last message of the room seen by reconnected client, given either by sequence number or by ID
+type resumePoint struct {
+	seq       int64
+	messageID string
+}
+
+func (p resumePoint) set() bool {
+	return p.seq != 0 || p.messageID != ""
+}
+
+// parseResumePoint reads resume point from last_seq or last_id query parameter of WS upgrade, last_seq wins if both are set
+func parseResumePoint(r *http.Request) (resumePoint, error) {
+	query := r.URL.Query()
+	var p resumePoint
+	if raw := query.Get("last_seq"); raw != "" {
+		seq, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seq <= 0 {
+			return resumePoint{}, errBadResumePoint
+		}
+		p.seq = seq
+	}
+	if raw := query.Get("last_id"); raw != "" {
+		messageID, err := uuid.Parse(raw)
+		if err != nil {
+			return resumePoint{}, errBadResumePoint
+		}
+		p.messageID = messageID.String()
+	}
+	return p, nil
+}
+
+// resume replays messages of current room missed since resume point as resumed history pages, then switches
+// connection stored held to live delivery. Live frames broadcast meanwhile follow the replay, messages which were
+// already replayed are skipped
+func (s *session) resume(ctx context.Context, point resumePoint) {
+	log := s.container.Log
+
+	var head int64
+	defer func() {
+		err := s.container.ClientManager.Resume(s.con, func(env response.Envelope) bool {
+			if env.Type != response.TypeMessage {
+				return true
+			}
+			var msg response.Msg
+			return env.Decode(&msg) != nil || msg.Room != s.room || msg.Seq > head
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("failed to resume live delivery")
+		}
+	}()
+
+	after, err := s.resumeSeq(ctx, point)
+	if err != nil {
+		if errors.Is(err, rediska.ErrMessageNotFound) || errors.Is(err, directory.ErrNotFound) {
+			s.write(response.NewError("", response.ErrCodeNotFound, "resume point not found"))
+		} else {
+			log.Error().Err(err).Msg("failed to find resume point")
+			s.write(response.NewError("", response.ErrCodeInternal, "failed to resume session"))
+		}
+		s.outputRecent(ctx)
+		return
+	}
+
+	messages, truncated, err := s.missed(ctx, after)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get missed messages")
+		s.write(response.NewError("", response.ErrCodeInternal, "failed to replay missed messages"))
+		s.outputRecent(ctx)
+		return
+	}
+	head = after
+	if len(messages) > 0 {
+		head = messages[len(messages)-1].Seq
+	}
+
+	// at least one page is sent, so client knows the session is resumed
+	state := s.readState(ctx)
+	pageLimit := s.container.Cfg.History.PageLimit
+	for i := 0; i == 0 || i < len(messages); i += pageLimit {
+		payload := response.HistoryPayload{
+			Room:     s.room,
+			Messages: messages[i:min(i+pageLimit, len(messages))],
+			Resumed:  true,
+		}
+		if i == 0 {
+			payload.LastRead = state.LastRead
+			payload.Unread = state.Unread
+			payload.Truncated = truncated
+		}
+		env, err := response.NewEnvelope(response.TypeHistory, "", payload)
+		if err != nil {
+			log.Error().Err(err).Send()
+			return
+		}
+		s.write(env)
+	}
+}
+
+// resumeSeq returns sequence number of the last message client has seen in current room
+func (s *session) resumeSeq(ctx context.Context, point resumePoint) (int64, error) {
+	if point.seq != 0 {
+		return point.seq, nil
+	}
+
+	msg, err := s.container.RedisRepo.FindMessage(ctx, s.room, point.messageID)
+	if errors.Is(err, rediska.ErrMessageNotFound) {
+		msg, err = s.container.Archive.MessageByID(ctx, point.messageID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if msg.Room != s.room || msg.Seq == 0 {
+		return 0, directory.ErrNotFound
+	}
+	return msg.Seq, nil
+}
+
+// missed returns messages of current room following the sequence number, the latest SRV_RESUME_LIMIT of them if there
+// are more (reported as truncated). Cache is completed by older messages from storage service if it doesn't reach
+// back to the sequence number
+func (s *session) missed(ctx context.Context, after int64) ([]response.Msg, bool, error) {
+	limit := s.container.Cfg.History.ResumeLimit
+	cached, complete, err := s.container.RedisRepo.GetSince(ctx, s.room, after)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(cached) > limit {
+		return cached[len(cached)-limit:], true, nil
+	}
+	if complete {
+		return cached, false, nil
+	}
+
+	// storage is read up to the oldest cached message, since it may not have the latest ones yet
+	var until int64
+	if len(cached) > 0 {
+		until = cached[0].Seq
+	} else {
+		last, err := s.container.Archive.LastSeq(ctx, s.room)
+		if err != nil {
+			return nil, false, err
+		}
+		until = last + 1
+	}
+
+	from := after
+	var truncated bool
+	if rest := int64(limit - len(cached)); until-1-from > rest {
+		from = until - 1 - rest
+		truncated = true
+	}
+
+	var stored []response.Msg
+	pageLimit := s.container.Cfg.History.PageLimit
+	for from < until-1 {
+		page, err := s.container.Archive.RoomSince(ctx, s.room, from, pageLimit)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, msg := range page {
+			if msg.Seq < until {
+				stored = append(stored, msg)
+			}
+		}
+		if len(page) < pageLimit {
+			break
+		}
+		from = page[len(page)-1].Seq
+	}
+	if err = s.container.RedisRepo.FillReactions(ctx, stored); err != nil {
+		s.container.Log.Error().Err(err).Msg("failed to get reactions of missed messages")
+	}
+
+	return append(stored, cached...), truncated, nil
+}
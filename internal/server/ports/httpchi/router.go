@@ -2,30 +2,59 @@ package httpchi
 
 import (
 	"context"
+	"expvar"
 	"net"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
 	"github.com/vlasashk/websocket-chat/internal/server/resources"
+	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
-func NewServer(ctx context.Context, container *resources.Resources) *http.Server {
+func NewServer(ctx context.Context, container *resources.Resources) (*http.Server, error) {
 	cfg := container.Cfg
+	router, err := newRouter(ctx, container)
+	if err != nil {
+		return nil, err
+	}
 	return &http.Server{
 		Addr:    net.JoinHostPort(cfg.Server.Host, cfg.Server.Port),
-		Handler: newRouter(ctx, container),
-	}
+		Handler: router,
+	}, nil
 }
 
-func newRouter(ctx context.Context, container *resources.Resources) http.Handler {
+func newRouter(ctx context.Context, container *resources.Resources) (http.Handler, error) {
+	chat, err := EstablishWS(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.URLFormat)
 	r.Use(middleware.CleanPath)
 	r.Use(middleware.Recoverer)
-	r.Get("/chat", EstablishWS(ctx, container))
+	r.Get("/chat", chat)
+	r.Get("/online", OnlineUsers(container))
 	r.Get("/healthz", HealthCheck)
-	return r
+	// metrics expose process internals (e.g. command line), so they are served to internal services only
+	r.With(serviceOnly(container.Auth)).Get("/debug/vars", expvar.Handler().ServeHTTP)
+	return r, nil
+}
+
+// serviceOnly rejects requests without valid service token
+func serviceOnly(verifier resources.TokenVerifier) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if claims, err := authenticate(r, verifier); err != nil || !claims.Service {
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, response.ErrResp{Error: "unauthorized"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
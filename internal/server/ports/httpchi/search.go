@@ -0,0 +1,56 @@
+package httpchi
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchQueryLen  = 200
+)
+
+// handleSearch answers with stored messages matching full-text query among room messages and direct messages of
+// the user. Messages reach storage asynchronously, so the latest ones may be missing
+func (s *session) handleSearch(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.SearchRequest
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed search payload"))
+		return
+	}
+	req.Query = strings.TrimSpace(req.Query)
+	if length := utf8.RuneCountInString(req.Query); length == 0 || length > maxSearchQueryLen {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "search query length is not supported"))
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultSearchLimit
+	}
+	if req.Limit < 0 || req.Limit > s.container.Cfg.History.PageLimit || req.Offset < 0 {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "search limit or offset is not supported"))
+		return
+	}
+
+	page, err := s.container.Archive.Search(ctx, s.userID, req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to search messages")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to search messages"))
+		return
+	}
+
+	reply, err := response.NewEnvelope(response.TypeSearch, env.ID, response.SearchPayload{
+		Query:      req.Query,
+		Results:    page.Results,
+		NextOffset: page.NextOffset,
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.write(reply)
+}
@@ -0,0 +1,541 @@
+package httpchi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/directory"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/rediska"
+	"github.com/vlasashk/websocket-chat/internal/server/metrics"
+	"github.com/vlasashk/websocket-chat/internal/server/resources"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// session holds state of single registered WS connection
+type session struct {
+	con       *websocket.Conn
+	remoteIP  string
+	container *resources.Resources
+	broadcast chan<- response.Broadcast
+	userID    int
+	username  string
+	room      string
+	typing    typingState
+	// receipts last acknowledged message in current room by receipt kind
+	receipts map[string]string
+}
+
+// handle decodes single frame received from client and dispatches it by envelope type. Error means that
+// connection must be dropped
+func (s *session) handle(ctx context.Context, data []byte) error {
+	log := s.container.Log
+
+	// every frame is rate limited, including malformed ones
+	var env response.Envelope
+	decodeErr := json.Unmarshal(data, &env)
+	_, limited := limitedTypes[env.Type]
+	if allowed, err := s.throttle(ctx, env.ID, decodeErr != nil || !limited); !allowed {
+		return err
+	}
+
+	if decodeErr != nil {
+		log.Error().Err(decodeErr).Msg("failed to unmarshal envelope")
+		s.write(response.NewError("", response.ErrCodeBadRequest, "malformed envelope"))
+		return nil
+	}
+
+	if env.Version != response.ProtocolVersion {
+		s.write(response.NewError(env.ID, response.ErrCodeUnsupportedVersion, "unsupported protocol version"))
+		return nil
+	}
+
+	switch env.Type {
+	case response.TypeMessage:
+		s.handleMessage(ctx, env)
+	case response.TypeDirect:
+		s.handleDirect(ctx, env)
+	case response.TypeEdit:
+		s.handleEdit(ctx, env)
+	case response.TypeDelete:
+		s.handleDelete(ctx, env)
+	case response.TypeReaction:
+		s.handleReaction(ctx, env)
+	case response.TypeTyping:
+		s.handleTyping(ctx, env)
+	case response.TypeReceipt:
+		s.handleReceipt(ctx, env)
+	case response.TypeReadBy:
+		s.handleReadBy(ctx, env)
+	case response.TypeRoster:
+		s.roster(ctx, env.ID)
+	case response.TypeHistory:
+		s.handleHistory(ctx, env)
+	case response.TypeSearch:
+		s.handleSearch(ctx, env)
+	case response.TypeJoin:
+		s.handleJoin(ctx, env)
+	default:
+		s.write(response.NewError(env.ID, response.ErrCodeUnsupportedType, "unsupported envelope type"))
+	}
+	return nil
+}
+
+func (s *session) handleMessage(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var msg response.Msg
+	if err := env.Decode(&msg); err != nil {
+		log.Error().Err(err).Msg("failed to unmarshal msg")
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed message payload"))
+		return
+	}
+	if msg.Text == "" {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "empty message"))
+		return
+	}
+	if utf8.RuneCountInString(msg.Text) > maxTextLen {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "message is too long"))
+		return
+	}
+	s.stampIdentity(&msg)
+	msg.Room = s.room
+	msg.RecipientID = 0
+	msg.Recipient = ""
+	// sent message ends typing
+	s.stopTyping(ctx)
+
+	s.send(ctx, env.ID, msg)
+}
+
+// handleDirect sends private message to user addressed by ID or username
+func (s *session) handleDirect(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var msg response.Msg
+	if err := env.Decode(&msg); err != nil {
+		log.Error().Err(err).Msg("failed to unmarshal direct msg")
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed message payload"))
+		return
+	}
+	if msg.Text == "" {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "empty message"))
+		return
+	}
+	if utf8.RuneCountInString(msg.Text) > maxTextLen {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "message is too long"))
+		return
+	}
+
+	var recipient response.User
+	var err error
+	switch {
+	case msg.RecipientID != 0:
+		recipient, err = s.container.Users.UserByID(ctx, msg.RecipientID)
+	case msg.Recipient != "":
+		recipient, err = s.container.Users.UserByName(ctx, msg.Recipient)
+	default:
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "recipient is not specified"))
+		return
+	}
+	if err != nil {
+		if errors.Is(err, directory.ErrNotFound) {
+			s.write(response.NewError(env.ID, response.ErrCodeNotFound, "recipient not found"))
+			return
+		}
+		log.Error().Err(err).Msg("failed to resolve recipient")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to resolve recipient"))
+		return
+	}
+
+	s.stampIdentity(&msg)
+	msg.Room = ""
+	msg.RecipientID = recipient.UserID
+	msg.Recipient = recipient.Username
+
+	s.send(ctx, env.ID, msg)
+}
+
+// send stores message, acks client's frame and passes direct message to broadcast. Room message is already
+// published by cache in sequence order. Resent message is acked again, but neither stored nor broadcast
+func (s *session) send(ctx context.Context, id string, msg response.Msg) {
+	log := s.container.Log
+
+	if len(msg.IdempotencyKey) > maxIdempotencyKeyLen {
+		s.write(response.NewError(id, response.ErrCodeBadRequest, "idempotency key is too long"))
+		return
+	}
+
+	err := storeMessage(ctx, s.container, &msg)
+	if errors.Is(err, errDuplicateMessage) {
+		log.Debug().Int("user_id", s.userID).Str("idempotency_key", msg.IdempotencyKey).Msg("duplicate message")
+		s.ack(id)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Send()
+		s.write(response.NewError(id, response.ErrCodeInternal, "failed to store message"))
+		return
+	}
+	msg.Print()
+	s.ack(id)
+
+	if msg.RecipientID != 0 {
+		s.publish(ctx, response.TypeDirect, msg)
+	}
+}
+
+// handleEdit replaces text of own message. Message is looked up in cache of current room first, since
+// recently sent messages may not be stored yet, then in storage service
+func (s *session) handleEdit(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.EditPayload
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed edit payload"))
+		return
+	}
+	if req.MessageID == "" || req.Text == "" {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "message ID and text are required"))
+		return
+	}
+	if utf8.RuneCountInString(req.Text) > maxTextLen {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "message is too long"))
+		return
+	}
+
+	edit := response.MessageEdit{
+		MessageID: req.MessageID,
+		UserID:    s.userID,
+		Text:      req.Text,
+		EditedAt:  time.Now().UTC(),
+	}
+
+	msg, cached, err := s.applyToMessage(ctx, edit.MessageID, false, func(room string) (response.Msg, error) {
+		return s.container.RedisRepo.EditMessage(ctx, room, edit)
+	})
+	if err != nil {
+		s.writeMessageErr(env.ID, "edit", err)
+		return
+	}
+	if !cached {
+		msg.Text = edit.Text
+		msg.EditedAt = &edit.EditedAt
+	}
+
+	event, err := response.NewEvent(response.EventEdit, edit)
+	if err != nil {
+		log.Error().Err(err).Send()
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to edit message"))
+		return
+	}
+	if err = s.container.KafkaWriter.Write(ctx, eventKey(msg), event); err != nil {
+		log.Error().Err(err).Msg("failed to write event")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to edit message"))
+		return
+	}
+	s.ack(env.ID)
+
+	s.publish(ctx, response.TypeEdit, msg)
+}
+
+// handleDelete removes own message, moderator may remove any message
+func (s *session) handleDelete(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.DeletePayload
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed delete payload"))
+		return
+	}
+	if req.MessageID == "" {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "message ID is required"))
+		return
+	}
+
+	// role is looked up on each takedown, so granted or revoked role takes effect without new token
+	user, err := s.container.Users.UserByID(ctx, s.userID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to look up role")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to delete message"))
+		return
+	}
+	del := response.MessageDelete{
+		MessageID: req.MessageID,
+		UserID:    s.userID,
+		Moderator: user.Moderator,
+		DeletedAt: time.Now().UTC(),
+	}
+
+	msg, _, err := s.applyToMessage(ctx, del.MessageID, del.Moderator, func(room string) (response.Msg, error) {
+		return s.container.RedisRepo.DeleteMessage(ctx, room, del)
+	})
+	if err != nil {
+		s.writeMessageErr(env.ID, "delete", err)
+		return
+	}
+	if msg.UserID != s.userID {
+		log.Info().Int("moderator_id", s.userID).Str("message_id", msg.ID).Int("author_id", msg.UserID).Msg("message taken down")
+	}
+
+	event, err := response.NewEvent(response.EventDelete, del)
+	if err != nil {
+		log.Error().Err(err).Send()
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to delete message"))
+		return
+	}
+	if err = s.container.KafkaWriter.Write(ctx, eventKey(msg), event); err != nil {
+		log.Error().Err(err).Msg("failed to write event")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to delete message"))
+		return
+	}
+	s.ack(env.ID)
+
+	notice, err := response.NewEnvelope(response.TypeDelete, "", response.DeletePayload{MessageID: msg.ID, DeletedBy: s.userID})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.broadcastEnvelope(ctx, msg, notice)
+}
+
+// handleReaction adds or removes user's reaction on message visible to the user
+func (s *session) handleReaction(ctx context.Context, env response.Envelope) {
+	log := s.container.Log
+
+	var req response.ReactionPayload
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed reaction payload"))
+		return
+	}
+	if req.MessageID == "" || !validEmoji(req.Emoji) {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "message ID and valid emoji are required"))
+		return
+	}
+
+	msg, _, err := s.applyToMessage(ctx, req.MessageID, true, func(room string) (response.Msg, error) {
+		return s.container.RedisRepo.FindMessage(ctx, room, req.MessageID)
+	})
+	if err == nil && msg.RecipientID != 0 && msg.RecipientID != s.userID && msg.UserID != s.userID {
+		// direct message of other users
+		err = directory.ErrNotFound
+	}
+	if err != nil {
+		s.writeMessageErr(env.ID, "react to", err)
+		return
+	}
+
+	reaction := response.MessageReaction{
+		MessageID: msg.ID,
+		UserID:    s.userID,
+		Emoji:     req.Emoji,
+		Remove:    req.Remove,
+		ReactedAt: time.Now().UTC(),
+	}
+	count, changed, err := s.react(ctx, reaction)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to cache reaction")
+		s.write(response.NewError(env.ID, response.ErrCodeInternal, "failed to react to message"))
+		return
+	}
+	s.ack(env.ID)
+	if !changed {
+		return
+	}
+
+	event, err := response.NewEvent(response.EventReaction, reaction)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	if err = s.container.KafkaWriter.Write(ctx, eventKey(msg), event); err != nil {
+		log.Error().Err(err).Msg("failed to write event")
+	}
+
+	update, err := response.NewEnvelope(response.TypeReaction, "", response.ReactionPayload{
+		MessageID: msg.ID,
+		Emoji:     reaction.Emoji,
+		Remove:    reaction.Remove,
+		UserID:    s.userID,
+		Username:  s.username,
+		Count:     count,
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.broadcastEnvelope(ctx, msg, update)
+}
+
+// applyToMessage runs cache operation on message of current room. Message which is not cached there (older or direct
+// message, or message of another room) is looked up in storage service and checked to be user's own unless anyAuthor
+// is set, then cache of its own room is tried. Reports whether the operation was applied to cached copy, otherwise
+// stored message is returned as is
+func (s *session) applyToMessage(ctx context.Context, messageID string, anyAuthor bool, op func(room string) (response.Msg, error)) (response.Msg, bool, error) {
+	msg, err := op(s.room)
+	if !errors.Is(err, rediska.ErrMessageNotFound) {
+		return msg, err == nil, err
+	}
+
+	stored, err := s.container.Archive.MessageByID(ctx, messageID)
+	if err != nil {
+		return response.Msg{}, false, err
+	}
+	if stored.UserID != s.userID && !anyAuthor {
+		return response.Msg{}, false, rediska.ErrNotAuthor
+	}
+
+	if stored.Room != "" && stored.Room != s.room {
+		msg, err = op(stored.Room)
+		if !errors.Is(err, rediska.ErrMessageNotFound) {
+			return msg, err == nil, err
+		}
+	}
+	return stored, false, nil
+}
+
+// react applies reaction in cache. Reactions of the message which are not cached (e.g. they expired) are seeded from
+// storage first, so count and reactors of the emoji reflect reactions made before
+func (s *session) react(ctx context.Context, reaction response.MessageReaction) (int, bool, error) {
+	cache := s.container.RedisRepo
+
+	count, changed, err := cache.React(ctx, reaction)
+	if !errors.Is(err, rediska.ErrNoReactions) {
+		return count, changed, err
+	}
+
+	stored, err := s.container.Archive.Reactions(ctx, reaction.MessageID)
+	if err != nil {
+		return 0, false, err
+	}
+	if err = cache.SeedReactions(ctx, reaction.MessageID, stored); err != nil {
+		return 0, false, err
+	}
+	return cache.React(ctx, reaction)
+}
+
+// writeMessageErr reports failure of message operation to client
+func (s *session) writeMessageErr(id, op string, err error) {
+	switch {
+	case errors.Is(err, rediska.ErrMessageNotFound), errors.Is(err, directory.ErrNotFound):
+		s.write(response.NewError(id, response.ErrCodeNotFound, "message not found"))
+	case errors.Is(err, rediska.ErrNotAuthor):
+		s.write(response.NewError(id, response.ErrCodeForbidden, "not allowed to "+op+" message of another user"))
+	default:
+		s.container.Log.Error().Err(err).Str("op", op).Msg("failed to apply message operation")
+		s.write(response.NewError(id, response.ErrCodeInternal, "failed to "+op+" message"))
+	}
+}
+
+// publish passes message wrapped into envelope of given type to broadcast
+func (s *session) publish(ctx context.Context, envType response.EnvelopeType, msg response.Msg) {
+	env, err := response.NewEnvelope(envType, "", msg)
+	if err != nil {
+		s.container.Log.Error().Err(err).Msg("failed to wrap broadcast msg")
+		return
+	}
+	s.broadcastEnvelope(ctx, msg, env)
+}
+
+// broadcastEnvelope passes frame to broadcast addressing it to audience of the message. Frames of the session
+// reach broadcast in the order they are passed
+func (s *session) broadcastEnvelope(ctx context.Context, msg response.Msg, env response.Envelope) {
+	b := response.Broadcast{
+		Room:        msg.Room,
+		UserID:      msg.UserID,
+		RecipientID: msg.RecipientID,
+		Envelope:    env,
+	}
+
+	select {
+	case <-ctx.Done():
+	case s.broadcast <- b:
+	}
+}
+
+func (s *session) handleJoin(ctx context.Context, env response.Envelope) {
+	var join response.JoinPayload
+	if err := env.Decode(&join); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed join payload"))
+		return
+	}
+
+	if !validName(join.Room) {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "room name length is not supported"))
+		return
+	}
+
+	s.stopTyping(ctx)
+	s.exit(ctx)
+	s.room = join.Room
+	s.receipts = nil
+	s.container.ClientManager.Join(s.con, s.room)
+	s.enter(ctx)
+	s.ack(env.ID)
+	s.outputRecent(ctx)
+}
+
+// stampIdentity replaces client supplied identity with the one bound to connection, counting forgery attempts
+func (s *session) stampIdentity(msg *response.Msg) {
+	log := s.container.Log
+
+	if msg.UserID != 0 && msg.UserID != s.userID {
+		metrics.SpoofAttempts.Add(metrics.SpoofUserID, 1)
+		log.Warn().Int("user_id", s.userID).Int("claimed_user_id", msg.UserID).Msg("user ID spoofing attempt")
+	}
+	if msg.Username != "" && msg.Username != s.username {
+		metrics.SpoofAttempts.Add(metrics.SpoofUsername, 1)
+		log.Warn().Int("user_id", s.userID).Str("claimed_username", msg.Username).Msg("username spoofing attempt")
+	}
+
+	msg.UserID = s.userID
+	msg.Username = s.username
+}
+
+// outputRecent sends to client recent messages of current room as single history frame along with read position of the user
+func (s *session) outputRecent(ctx context.Context) {
+	log := s.container.Log
+
+	recentMessages, err := s.container.RedisRepo.GetLastTen(ctx, s.room)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get messages from db")
+		return
+	}
+
+	state := s.readState(ctx)
+	env, err := response.NewEnvelope(response.TypeHistory, "", response.HistoryPayload{
+		Room:     s.room,
+		Messages: recentMessages,
+		LastRead: state.LastRead,
+		Unread:   state.Unread,
+	})
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+	s.write(env)
+}
+
+// hello tells client its identity bound to the connection
+func (s *session) hello() {
+	env, err := response.NewEnvelope(response.TypeHello, "", response.HelloPayload{
+		UserID:   s.userID,
+		Username: s.username,
+	})
+	if err != nil {
+		s.container.Log.Error().Err(err).Send()
+		return
+	}
+	s.write(env)
+}
+
+func (s *session) ack(id string) {
+	s.write(response.Envelope{Version: response.ProtocolVersion, Type: response.TypeAck, ID: id})
+}
+
+func (s *session) write(env response.Envelope) {
+	writeEnvelope(s.container.Log, s.container.ClientManager, s.con, env)
+}
@@ -0,0 +1,104 @@
+package httpchi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// typingState typing indicator of single connection. It's accessed by connection reader and expiry timer
+type typingState struct {
+	mu     sync.Mutex
+	active bool
+	room   string
+	sentAt time.Time
+	expiry *time.Timer
+	// gen invalidates expiry timers which were already fired when indicator got refreshed
+	gen int
+}
+
+// handleTyping fans out typing indicator to other members of the room, throttling refreshes
+func (s *session) handleTyping(ctx context.Context, env response.Envelope) {
+	var req response.TypingPayload
+	if err := env.Decode(&req); err != nil {
+		s.write(response.NewError(env.ID, response.ErrCodeBadRequest, "malformed typing payload"))
+		return
+	}
+
+	if !req.Typing {
+		s.stopTyping(ctx)
+		return
+	}
+
+	cfg := s.container.Cfg.Typing
+	t := &s.typing
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if !t.active || now.Sub(t.sentAt) >= cfg.Throttle {
+		t.active = true
+		t.room = s.room
+		t.sentAt = now
+		s.publishTyping(ctx, t.room, true)
+	}
+
+	t.gen++
+	gen := t.gen
+	if t.expiry != nil {
+		t.expiry.Stop()
+	}
+	t.expiry = time.AfterFunc(cfg.Timeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.gen != gen || !t.active {
+			return
+		}
+		t.active = false
+		s.publishTyping(ctx, t.room, false)
+	})
+}
+
+// stopTyping clears active indicator, it's called on explicit stop, message, room switch and disconnect
+func (s *session) stopTyping(ctx context.Context) {
+	t := &s.typing
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gen++
+	if t.expiry != nil {
+		t.expiry.Stop()
+	}
+	if !t.active {
+		return
+	}
+	t.active = false
+	s.publishTyping(ctx, t.room, false)
+}
+
+// publishTyping must be called with typing mutex held, so indicator changes reach broadcast in the order they happen
+func (s *session) publishTyping(ctx context.Context, room string, typing bool) {
+	env, err := response.NewEnvelope(response.TypeTyping, "", response.TypingPayload{
+		Typing:   typing,
+		UserID:   s.userID,
+		Username: s.username,
+		Room:     room,
+	})
+	if err != nil {
+		s.container.Log.Error().Err(err).Send()
+		return
+	}
+
+	b := response.Broadcast{
+		Room:          room,
+		UserID:        s.userID,
+		ExcludeUserID: s.userID,
+		Envelope:      env,
+	}
+	select {
+	case <-ctx.Done():
+	case s.broadcast <- b:
+	}
+}
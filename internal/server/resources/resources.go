@@ -5,9 +5,13 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/directory"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/fanout"
 	"github.com/vlasashk/websocket-chat/internal/server/adapters/manager"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/outbox"
+	"github.com/vlasashk/websocket-chat/internal/server/adapters/presence"
 	"github.com/vlasashk/websocket-chat/internal/server/adapters/rediska"
-	"github.com/vlasashk/websocket-chat/pkg/kakafka"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
 	"github.com/vlasashk/websocket-chat/pkg/logger"
 )
 
@@ -17,6 +21,12 @@ type Resources struct {
 	ClientManager ClientManager
 	RedisRepo     CacheRepo
 	KafkaWriter   MessageBroker
+	Auth          TokenVerifier
+	Users         UserDirectory
+	Archive       MessageArchive
+	Limiter       RateLimiter
+	Fanout        Fanout
+	Presence      Presence
 }
 
 func New(ctx context.Context, cfg config.ServerCfg) (*Resources, error) {
@@ -25,18 +35,36 @@ func New(ctx context.Context, cfg config.ServerCfg) (*Resources, error) {
 		return nil, err
 	}
 
+	cm, err := manager.New(log, cfg.SendQueue, cfg.Conn.Heartbeat.WriteWait)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := auth.NewSigner(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := directory.New(cfg.Storage, signer)
 	res := Resources{
 		Cfg:           cfg,
 		Log:           log,
-		ClientManager: manager.New(log),
-		KafkaWriter:   kakafka.NewProducer(ctx, cfg.Kafka, log),
+		ClientManager: cm,
+		Auth:          signer,
+		Users:         storage,
+		Archive:       storage,
 	}
 
 	repo, err := rediska.NewClient(res.Cfg.Redis)
 	if err != nil {
 		return nil, err
 	}
+	repo.Outbox = cfg.Outbox.Stream
 	res.RedisRepo = repo
+	res.Limiter = repo
+	res.Fanout = fanout.New(repo, cfg.Fanout, log)
+	res.KafkaWriter = outbox.New(repo.Client, cfg.Outbox, cfg.Kafka, log)
+	res.Presence = presence.New(repo.Client, cfg.Presence, log)
 
 	return &res, nil
 }
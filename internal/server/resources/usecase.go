@@ -2,23 +2,86 @@ package resources
 
 import (
 	"context"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
 type ClientManager interface {
-	Store(con *websocket.Conn)
+	Store(con *websocket.Conn, room string, user response.User)
+	StoreHeld(con *websocket.Conn, room string, user response.User)
+	Resume(con *websocket.Conn, keep func(env response.Envelope) bool) error
+	Join(con *websocket.Conn, room string)
 	Release(con *websocket.Conn)
-	Broadcaster(ctx context.Context) chan<- response.Msg
-	WriteMsg(con *websocket.Conn, msg response.Msg) error
+	Broadcaster(ctx context.Context) chan<- response.Broadcast
+	Write(con *websocket.Conn, env response.Envelope) error
 }
 
 type CacheRepo interface {
-	AddMessage(ctx context.Context, data []byte) error
-	GetLastTen(ctx context.Context) ([]response.Msg, error)
+	AddMessage(ctx context.Context, msg *response.Msg, channel string) error
+	PendingSequence(ctx context.Context, room string) (int64, error)
+	SeedSequence(ctx context.Context, room string, last int64) error
+	GetLastTen(ctx context.Context, room string) ([]response.Msg, error)
+	GetPage(ctx context.Context, room, before string, limit int) ([]response.Msg, error)
+	GetSince(ctx context.Context, room string, after int64) ([]response.Msg, bool, error)
+	EditMessage(ctx context.Context, room string, edit response.MessageEdit) (response.Msg, error)
+	DeleteMessage(ctx context.Context, room string, del response.MessageDelete) (response.Msg, error)
+	FindMessage(ctx context.Context, room, messageID string) (response.Msg, error)
+	React(ctx context.Context, reaction response.MessageReaction) (int, bool, error)
+	SeedReactions(ctx context.Context, messageID string, reactions []response.MessageReaction) error
+	FillReactions(ctx context.Context, messages []response.Msg) error
+	ClaimMessage(ctx context.Context, userID int, key, messageID string) (response.Claim, bool, error)
+	TakeOverMessage(ctx context.Context, userID int, key string, stale response.Claim, messageID string) (bool, error)
+	CommitMessage(ctx context.Context, userID int, key, messageID string) error
+	ReleaseMessage(ctx context.Context, userID int, key, messageID string) error
 }
 
+// Fanout shares broadcasts with other server instances
+type Fanout interface {
+	Relay(ctx context.Context, local chan<- response.Broadcast) (chan<- response.Broadcast, error)
+}
+
+// Presence tracks users present in rooms across all server instances
+type Presence interface {
+	Join(ctx context.Context, room string, user response.Member) (bool, error)
+	Leave(ctx context.Context, room string, userID int) (bool, error)
+	Roster(ctx context.Context, room string) ([]response.Member, error)
+	Online(ctx context.Context) ([]response.OnlineUser, error)
+	Watch(ctx context.Context, broadcast chan<- response.Broadcast)
+}
+
+// RateLimiter keeps rate limit state shared by all server instances
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, rate float64, burst int) (bool, error)
+	Violate(ctx context.Context, userID int, window time.Duration, muteAfter int, mute time.Duration) (int, error)
+	MutedFor(ctx context.Context, userID int) (time.Duration, error)
+}
+
+type TokenVerifier interface {
+	Parse(token string) (auth.Claims, error)
+}
+
+type UserDirectory interface {
+	UserByID(ctx context.Context, userID int) (response.User, error)
+	UserByName(ctx context.Context, username string) (response.User, error)
+}
+
+type MessageArchive interface {
+	MessageByID(ctx context.Context, messageID string) (response.Msg, error)
+	Reactions(ctx context.Context, messageID string) ([]response.MessageReaction, error)
+	RoomHistory(ctx context.Context, room, before string, limit int) ([]response.Msg, error)
+	RoomSince(ctx context.Context, room string, after int64, limit int) ([]response.Msg, error)
+	LastSeq(ctx context.Context, room string) (int64, error)
+	Search(ctx context.Context, viewerID int, req response.SearchRequest) (response.SearchPage, error)
+	ReadState(ctx context.Context, userID int, room string) (response.ReadState, error)
+	ReadBy(ctx context.Context, room, messageID string) ([]response.ReadMarker, error)
+}
+
+// MessageBroker writes events keyed by room (or pair of users for direct messages), so events of the room keep order.
+// Relay passes written events to Kafka until ctx is done
 type MessageBroker interface {
-	Write(ctx context.Context, data []byte)
+	Write(ctx context.Context, key string, data []byte) error
+	Relay(ctx context.Context) error
 }
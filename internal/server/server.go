@@ -26,7 +26,14 @@ func Run(ctx context.Context, cfg config.ServerCfg) error {
 		return err
 	}
 
-	srv := httpchi.NewServer(gCtx, container)
+	srv, err := httpchi.NewServer(gCtx, container)
+	if err != nil {
+		return err
+	}
+
+	g.Go(func() error {
+		return container.KafkaWriter.Relay(gCtx)
+	})
 
 	g.Go(func() error {
 		container.Log.Info().Msg(fmt.Sprintf("starting server: %s", net.JoinHostPort(cfg.Server.Host, cfg.Server.Port)))
@@ -0,0 +1,114 @@
+package pgrepo
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	filterMessagesQuery = `SELECT m.message_id, COALESCE(m.seq, 0), m.user_id, u.username, COALESCE(m.room, ''), COALESCE(m.recipient_id, 0),
+	COALESCE(r.username, ''), m.content, m.sent_at, m.edited_at
+	FROM messages m
+	JOIN users u ON u.user_id = m.user_id
+	LEFT JOIN users r ON r.user_id = m.recipient_id
+	WHERE `
+	// matched terms are wrapped into ** markers, long messages are cut to fragments around them
+	searchMessagesQuery = `SELECT m.message_id, COALESCE(m.seq, 0), m.user_id, u.username, COALESCE(m.room, ''), COALESCE(m.recipient_id, 0),
+	COALESCE(r.username, ''), m.content, m.sent_at, m.edited_at, ts_rank(m.content_tsv, q.query) AS rank,
+	ts_headline('simple', m.content, q.query, 'StartSel=**, StopSel=**, MaxFragments=2, MaxWords=20, MinWords=5')
+	FROM messages m
+	CROSS JOIN websearch_to_tsquery('simple', $1) AS q(query)
+	JOIN users u ON u.user_id = m.user_id
+	LEFT JOIN users r ON r.user_id = m.recipient_id
+	WHERE m.content_tsv @@ q.query AND `
+)
+
+// FindMessages returns messages matching the filter, the newest first
+func (pg PgRepo) FindMessages(ctx context.Context, filter usecase.MessageFilter) ([]response.Msg, error) {
+	args := make([]any, 0, 7)
+	query := filterMessagesQuery + filterConds(filter, &args) + " ORDER BY m.message_id DESC LIMIT " + arg(&args, filter.Limit) + ";"
+
+	rows, err := pg.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]response.Msg, 0, filter.Limit)
+	for rows.Next() {
+		var msg response.Msg
+		if err = scanMsg(rows, &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// SearchMessages returns messages matching full-text query and the filter, the most relevant first.
+// Filter's Before is ignored, pages are skipped by offset since order doesn't follow message IDs
+func (pg PgRepo) SearchMessages(ctx context.Context, text string, filter usecase.MessageFilter, offset int) ([]response.SearchHit, error) {
+	args := []any{text}
+	filter.Before = ""
+	query := searchMessagesQuery + filterConds(filter, &args) +
+		" ORDER BY rank DESC, m.message_id DESC LIMIT " + arg(&args, filter.Limit) + " OFFSET " + arg(&args, offset) + ";"
+
+	rows, err := pg.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := make([]response.SearchHit, 0, filter.Limit)
+	for rows.Next() {
+		var hit response.SearchHit
+		if err = scanMsg(rows, &hit.Msg, &hit.Rank, &hit.Highlight); err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+// filterConds builds WHERE conditions of the filter appending their values to args
+func filterConds(filter usecase.MessageFilter, args *[]any) string {
+	conds := []string{"m.deleted_at IS NULL"}
+	if filter.Room != "" {
+		conds = append(conds, "m.room = "+arg(args, filter.Room))
+	}
+	if filter.UserID != 0 {
+		conds = append(conds, "m.user_id = "+arg(args, filter.UserID))
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "m.sent_at >= "+arg(args, filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "m.sent_at < "+arg(args, filter.Until))
+	}
+	if filter.Before != "" {
+		conds = append(conds, "m.message_id < "+arg(args, filter.Before)+"::uuid")
+	}
+	if filter.ViewerID != 0 {
+		viewer := arg(args, filter.ViewerID)
+		conds = append(conds, "(m.room IS NOT NULL OR m.user_id = "+viewer+" OR m.recipient_id = "+viewer+")")
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// arg appends query argument returning its placeholder
+func arg(args *[]any, v any) string {
+	*args = append(*args, v)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// scanMsg scans message columns of filter queries followed by extra columns
+func scanMsg(rows pgx.Rows, msg *response.Msg, extra ...any) error {
+	dest := append([]any{&msg.ID, &msg.Seq, &msg.UserID, &msg.Username, &msg.Room, &msg.RecipientID, &msg.Recipient,
+		&msg.Text, &msg.SentAt, &msg.EditedAt}, extra...)
+	return rows.Scan(dest...)
+}
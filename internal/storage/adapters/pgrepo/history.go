@@ -0,0 +1,65 @@
+package pgrepo
+
+import (
+	"context"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+	"github.com/vlasashk/websocket-chat/pkg/utils"
+)
+
+const (
+	// page is read newest first from the cursor and flipped to sequence order
+	roomHistoryQuery = `SELECT m.message_id, m.seq, m.user_id, u.username, m.room, m.content, m.sent_at, m.edited_at
+	FROM messages m
+	JOIN users u ON u.user_id = m.user_id
+	WHERE m.room = $1 AND m.deleted_at IS NULL
+		AND ($2 = '' OR m.seq < (SELECT seq FROM messages WHERE message_id = NULLIF($2, '')::uuid))
+	ORDER BY m.seq DESC
+	LIMIT $3;`
+	roomSinceQuery = `SELECT m.message_id, m.seq, m.user_id, u.username, m.room, m.content, m.sent_at, m.edited_at
+	FROM messages m
+	JOIN users u ON u.user_id = m.user_id
+	WHERE m.room = $1 AND m.deleted_at IS NULL AND m.seq > $2
+	ORDER BY m.seq
+	LIMIT $3;`
+)
+
+// GetRoomHistory returns up to limit messages of the room preceding message with given ID (or the latest ones if
+// it's empty) in sequence order along with their reaction counts
+func (pg PgRepo) GetRoomHistory(ctx context.Context, room, before string, limit int) ([]response.Msg, error) {
+	messages, err := pg.roomMessages(ctx, roomHistoryQuery, room, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	utils.FlipMessageOrder(messages)
+	return messages, pg.withReactions(ctx, messages)
+}
+
+// GetRoomSince returns up to limit messages of the room following the given sequence number in sequence order along
+// with their reaction counts
+func (pg PgRepo) GetRoomSince(ctx context.Context, room string, after int64, limit int) ([]response.Msg, error) {
+	messages, err := pg.roomMessages(ctx, roomSinceQuery, room, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return messages, pg.withReactions(ctx, messages)
+}
+
+// roomMessages runs room page query with room, cursor and limit arguments
+func (pg PgRepo) roomMessages(ctx context.Context, query, room string, cursor any, limit int) ([]response.Msg, error) {
+	rows, err := pg.Pool.Query(ctx, query, room, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]response.Msg, 0, limit)
+	for rows.Next() {
+		var msg response.Msg
+		if err = rows.Scan(&msg.ID, &msg.Seq, &msg.UserID, &msg.Username, &msg.Room, &msg.Text, &msg.SentAt, &msg.EditedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
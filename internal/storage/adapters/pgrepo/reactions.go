@@ -0,0 +1,69 @@
+package pgrepo
+
+import (
+	"context"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	reactionCountsQuery = `SELECT message_id, emoji, count(*) FROM message_reactions
+		WHERE message_id = ANY($1::uuid[])
+		GROUP BY message_id, emoji;`
+	reactionsQuery = `SELECT message_id, user_id, emoji, reacted_at FROM message_reactions
+		WHERE message_id = $1
+		ORDER BY reacted_at;`
+)
+
+// GetReactions returns reactions of the message, the oldest first
+func (pg PgRepo) GetReactions(ctx context.Context, messageID string) ([]response.MessageReaction, error) {
+	rows, err := pg.Pool.Query(ctx, reactionsQuery, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make([]response.MessageReaction, 0)
+	for rows.Next() {
+		var reaction response.MessageReaction
+		if err = rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji, &reaction.ReactedAt); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, reaction)
+	}
+	return reactions, rows.Err()
+}
+
+// withReactions fills reaction counts of messages
+func (pg PgRepo) withReactions(ctx context.Context, messages []response.Msg) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(messages))
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		index[msg.ID] = i
+		ids[i] = msg.ID
+	}
+
+	rows, err := pg.Pool.Query(ctx, reactionCountsQuery, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, emoji string
+		var count int
+		if err = rows.Scan(&messageID, &emoji, &count); err != nil {
+			return err
+		}
+		msg := &messages[index[messageID]]
+		if msg.Reactions == nil {
+			msg.Reactions = make(map[string]int)
+		}
+		msg.Reactions[emoji] = count
+	}
+	return rows.Err()
+}
@@ -0,0 +1,69 @@
+package pgrepo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	// GREATEST skips NULL, so delivery receipt ($4 is NULL) leaves read marker as is. Redelivered receipt changes nothing
+	saveReceiptQuery = `INSERT INTO read_markers (user_id, room, last_delivered, last_read, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, room) DO UPDATE SET
+			last_delivered = GREATEST(read_markers.last_delivered, EXCLUDED.last_delivered),
+			last_read = GREATEST(read_markers.last_read, EXCLUDED.last_read),
+			updated_at = GREATEST(read_markers.updated_at, EXCLUDED.updated_at);`
+	readMarkerQuery = `SELECT COALESCE(last_delivered::text, ''), COALESCE(last_read::text, '')
+		FROM read_markers WHERE user_id = $1 AND room = $2;`
+	unreadQuery = `SELECT count(*) FROM messages
+		WHERE room = $2 AND user_id <> $1 AND deleted_at IS NULL AND ($3 = '' OR message_id > NULLIF($3, '')::uuid);`
+	readByQuery = `SELECT r.user_id, u.username, r.last_read::text, r.updated_at
+		FROM read_markers r
+		JOIN users u ON u.user_id = r.user_id
+		WHERE r.room = $1 AND r.last_read >= $2
+		ORDER BY u.username;`
+)
+
+func (pg PgRepo) SaveReceipt(ctx context.Context, receipt response.Receipt) error {
+	var read *string
+	if receipt.Kind == response.ReceiptRead {
+		read = &receipt.MessageID
+	}
+	_, err := pg.Pool.Exec(ctx, saveReceiptQuery, receipt.UserID, receipt.Room, receipt.MessageID, read, receipt.At)
+	return rejected(err)
+}
+
+// GetReadState returns read position of user in the room, room which user never read has empty markers
+func (pg PgRepo) GetReadState(ctx context.Context, userID int, room string) (response.ReadState, error) {
+	state := response.ReadState{Room: room}
+	err := pg.Pool.QueryRow(ctx, readMarkerQuery, userID, room).Scan(&state.LastDelivered, &state.LastRead)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return response.ReadState{}, err
+	}
+
+	if err = pg.Pool.QueryRow(ctx, unreadQuery, userID, room, state.LastRead).Scan(&state.Unread); err != nil {
+		return response.ReadState{}, err
+	}
+	return state, nil
+}
+
+// GetReadBy returns users who have read the room up to the message or further
+func (pg PgRepo) GetReadBy(ctx context.Context, room, messageID string) ([]response.ReadMarker, error) {
+	rows, err := pg.Pool.Query(ctx, readByQuery, room, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	markers := make([]response.ReadMarker, 0)
+	for rows.Next() {
+		var marker response.ReadMarker
+		if err = rows.Scan(&marker.UserID, &marker.Username, &marker.LastRead, &marker.ReadAt); err != nil {
+			return nil, err
+		}
+		markers = append(markers, marker)
+	}
+	return markers, rows.Err()
+}
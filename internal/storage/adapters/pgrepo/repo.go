@@ -2,31 +2,283 @@ package pgrepo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+	"github.com/vlasashk/websocket-chat/pkg/utils"
 )
 
+// foreignKeyViolation SQLSTATE code
+const foreignKeyViolation = "23503"
+
 const (
-	addMsgQuery  = `INSERT INTO messages (user_id, content) VALUES ($1, $2);`
-	addUserQuery = `INSERT INTO users (username) VALUES ($1) RETURNING user_id;`
+	// direct messages have no room, room messages have no recipient. Message already stored under the same
+	// idempotency key is left as is, so redelivered message can't revert its later edits or deletion
+	addMsgQuery = `INSERT INTO messages (message_id, seq, user_id, room, recipient_id, content, sent_at, idempotency_key)
+		VALUES ($1, NULLIF($2, 0), $3, NULLIF($4, ''), NULLIF($5, 0), $6, $7, $8)
+		ON CONFLICT (user_id, idempotency_key) DO NOTHING;`
+	lastSeqQuery     = `SELECT COALESCE(max(seq), 0) FROM messages WHERE room = $1;`
+	messageByIDQuery = `SELECT m.message_id, COALESCE(m.seq, 0), m.user_id, u.username, COALESCE(m.room, ''), COALESCE(m.recipient_id, 0),
+		COALESCE(r.username, ''), m.content, m.sent_at, m.edited_at
+		FROM messages m
+		JOIN users u ON u.user_id = m.user_id
+		LEFT JOIN users r ON r.user_id = m.recipient_id
+		WHERE m.message_id = $1 AND m.deleted_at IS NULL;`
+	// previous text is kept in message_edits, edits older than the current revision are ignored (e.g. redelivered ones)
+	editMsgQuery = `WITH prev AS (
+			SELECT message_id, content FROM messages
+			WHERE message_id = $1 AND user_id = $2 AND deleted_at IS NULL AND (edited_at IS NULL OR edited_at < $4)
+			FOR UPDATE
+		), revision AS (
+			INSERT INTO message_edits (message_id, content, replaced_at) SELECT message_id, content, $4 FROM prev
+		)
+		UPDATE messages SET content = $3, edited_at = $4 FROM prev
+		WHERE messages.message_id = prev.message_id
+		RETURNING messages.message_id;`
+	// author deletes own message, moderator any message. Role is checked at the time of deletion, moderator flag of
+	// the event is not trusted
+	deleteMsgQuery = `UPDATE messages SET deleted_at = $3, deleted_by = $2
+		WHERE message_id = $1 AND deleted_at IS NULL
+			AND (user_id = $2 OR EXISTS (SELECT 1 FROM users WHERE users.user_id = $2 AND is_moderator))
+		RETURNING message_id;`
+	addReactionQuery = `INSERT INTO message_reactions (message_id, user_id, emoji, reacted_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING;`
+	removeReactionQuery = `DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3;`
+	// username of existing account is taken even if the account has no password yet
+	createUserQuery = `INSERT INTO users (username, username_key, password_hash) VALUES ($1, $2, $3)
+		ON CONFLICT (username_key) DO NOTHING
+		RETURNING user_id, username, is_moderator, created_at, token_version;`
+	userByIDQuery    = `SELECT user_id, username, is_moderator, created_at, token_version FROM users WHERE user_id = $1;`
+	userByNameQuery  = `SELECT user_id, username, is_moderator, created_at, token_version FROM users WHERE username_key = $1;`
+	credentialsQuery = `SELECT user_id, username, is_moderator, created_at, token_version, password_hash, failed_logins, locked_until
+		FROM users WHERE username_key = $1;`
+	// new password revokes tokens issued with the old one
+	setPasswordQuery = `UPDATE users SET password_hash = $2, token_version = token_version + 1 WHERE user_id = $1;`
+	// account created before passwords were introduced gets its first password
+	claimUserQuery = `UPDATE users SET password_hash = $2, token_version = token_version + 1
+		WHERE user_id = $1 AND password_hash IS NULL
+		RETURNING user_id;`
+	resetFailuresQuery = `UPDATE users SET failed_logins = 0, locked_until = NULL WHERE user_id = $1;`
+	// reaching maxFailed locks account and starts counting failures from scratch
+	loginFailureQuery = `UPDATE users SET
+		failed_logins = CASE WHEN failed_logins + 1 >= $2 THEN 0 ELSE failed_logins + 1 END,
+		locked_until = CASE WHEN failed_logins + 1 >= $2 THEN now() + $3 * INTERVAL '1 second' ELSE locked_until END
+		WHERE user_id = $1
+		RETURNING locked_until;`
 )
 
-func (pg PgRepo) AddMessage(ctx context.Context, userID int, msg string) error {
+// AddMessage stores message, ErrConflict is returned if message with the same idempotency key of the user is
+// already stored
+func (pg PgRepo) AddMessage(ctx context.Context, msg response.Msg) error {
 	start := time.Now()
-	if _, err := pg.Pool.Exec(ctx, addMsgQuery, userID, msg); err != nil {
-		return err
+	tag, err := pg.Pool.Exec(ctx, addMsgQuery, msg.ID, msg.Seq, msg.UserID, msg.Room, msg.RecipientID, msg.Text, msg.SentAt,
+		msg.IdempotencyKey)
+	if err != nil {
+		return rejected(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return usecase.ErrConflict
 	}
 	log.Info().Dur("postgres msg add time", time.Since(start)).Send()
 	return nil
 }
 
-func (pg PgRepo) AddUser(ctx context.Context, UserName string) (int, error) {
-	var userID int
+func (pg PgRepo) GetMessage(ctx context.Context, messageID string) (response.Msg, error) {
+	var msg response.Msg
+	err := pg.Pool.QueryRow(ctx, messageByIDQuery, messageID).Scan(&msg.ID, &msg.Seq, &msg.UserID, &msg.Username, &msg.Room,
+		&msg.RecipientID, &msg.Recipient, &msg.Text, &msg.SentAt, &msg.EditedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return response.Msg{}, usecase.ErrNotFound
+		}
+		return response.Msg{}, err
+	}
+	return msg, nil
+}
+
+// GetLastSeq returns the last sequence number used in the room, zero if the room has no messages
+func (pg PgRepo) GetLastSeq(ctx context.Context, room string) (int64, error) {
+	var seq int64
+	err := pg.Pool.QueryRow(ctx, lastSeqQuery, room).Scan(&seq)
+	return seq, err
+}
+
+// EditMessage replaces text of author's message keeping previous revision, ErrNotFound is returned if there is
+// no such message of the author or a newer edit is already applied
+func (pg PgRepo) EditMessage(ctx context.Context, edit response.MessageEdit) error {
+	start := time.Now()
+	var messageID string
+	err := pg.Pool.QueryRow(ctx, editMsgQuery, edit.MessageID, edit.UserID, edit.Text, edit.EditedAt).Scan(&messageID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return usecase.ErrNotFound
+		}
+		return rejected(err)
+	}
+	log.Info().Dur("postgres msg edit time", time.Since(start)).Send()
+	return nil
+}
+
+// DeleteMessage soft deletes message, ErrNotFound is returned if there is no such message the user may delete
+func (pg PgRepo) DeleteMessage(ctx context.Context, del response.MessageDelete) error {
+	start := time.Now()
+	var messageID string
+	err := pg.Pool.QueryRow(ctx, deleteMsgQuery, del.MessageID, del.UserID, del.DeletedAt).Scan(&messageID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return usecase.ErrNotFound
+		}
+		return rejected(err)
+	}
+	log.Info().Dur("postgres msg delete time", time.Since(start)).Send()
+	return nil
+}
+
+// ApplyReaction adds or removes user's reaction, repeated changes are no-op
+func (pg PgRepo) ApplyReaction(ctx context.Context, reaction response.MessageReaction) error {
+	var err error
+	if reaction.Remove {
+		_, err = pg.Pool.Exec(ctx, removeReactionQuery, reaction.MessageID, reaction.UserID, reaction.Emoji)
+	} else {
+		_, err = pg.Pool.Exec(ctx, addReactionQuery, reaction.MessageID, reaction.UserID, reaction.Emoji, reaction.ReactedAt)
+	}
+	return rejected(err)
+}
+
+// CreateUser registers account with password, ErrConflict is returned if username is already taken
+func (pg PgRepo) CreateUser(ctx context.Context, username, passwordHash string) (response.User, error) {
 	start := time.Now()
-	if err := pg.Pool.QueryRow(ctx, addUserQuery, UserName).Scan(&userID); err != nil {
-		return 0, err
+	row := pg.Pool.QueryRow(ctx, createUserQuery, utils.CanonicalUsername(username), utils.UsernameKey(username), passwordHash)
+	user, err := scanUser(row)
+	if err != nil {
+		if errors.Is(err, usecase.ErrNotFound) {
+			return response.User{}, usecase.ErrConflict
+		}
+		return response.User{}, err
 	}
 	log.Info().Dur("postgres user add time", time.Since(start)).Send()
-	return userID, nil
+	return user, nil
+}
+
+func (pg PgRepo) GetUserByID(ctx context.Context, userID int) (response.User, error) {
+	return scanUser(pg.Pool.QueryRow(ctx, userByIDQuery, userID))
+}
+
+func (pg PgRepo) GetUserByName(ctx context.Context, username string) (response.User, error) {
+	return scanUser(pg.Pool.QueryRow(ctx, userByNameQuery, utils.UsernameKey(username)))
+}
+
+// rejected wraps error of data which database refuses to store (data exception or integrity constraint violation)
+// into ErrRejected, foreign key violation into ErrNoReference, since referenced row may be stored later. Lost
+// connection and errors of database which is down or overloaded are wrapped into ErrUnavailable. Other errors are
+// returned as is
+func rejected(err error) error {
+	if unavailable(err) {
+		return fmt.Errorf("%w: %w", usecase.ErrUnavailable, err)
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch {
+	case pgErr.Code == foreignKeyViolation:
+		return fmt.Errorf("%w: %w", usecase.ErrNoReference, err)
+	case strings.HasPrefix(pgErr.Code, "22"), strings.HasPrefix(pgErr.Code, "23"):
+		return fmt.Errorf("%w: %w", usecase.ErrRejected, err)
+	}
+	return err
+}
+
+// unavailable reports whether error is caused by connection or state of database rather than by the request. SQLSTATE
+// classes: 08 connection exception, 40 transaction rollback (e.g. deadlock), 53 insufficient resources, 57 operator
+// intervention (e.g. shutdown), 58 system error
+func unavailable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code[:2] {
+		case "08", "40", "53", "57", "58":
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	return pgconn.SafeToRetry(err) || errors.As(err, &netErr) || errors.As(err, &connectErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func scanUser(row pgx.Row) (response.User, error) {
+	var user response.User
+	if err := row.Scan(&user.UserID, &user.Username, &user.Moderator, &user.CreatedAt, &user.TokenVersion); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return response.User{}, usecase.ErrNotFound
+		}
+		return response.User{}, err
+	}
+	return user, nil
+}
+
+func (pg PgRepo) GetCredentials(ctx context.Context, username string) (usecase.Credentials, error) {
+	var creds usecase.Credentials
+	var hash *string
+	var lockedUntil *time.Time
+
+	err := pg.Pool.QueryRow(ctx, credentialsQuery, utils.UsernameKey(username)).Scan(
+		&creds.User.UserID, &creds.User.Username, &creds.User.Moderator, &creds.User.CreatedAt, &creds.User.TokenVersion, &hash,
+		&creds.FailedLogins, &lockedUntil)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return usecase.Credentials{}, usecase.ErrNotFound
+		}
+		return usecase.Credentials{}, err
+	}
+
+	if hash != nil {
+		creds.PasswordHash = *hash
+	}
+	if lockedUntil != nil {
+		creds.LockedUntil = *lockedUntil
+	}
+	return creds, nil
+}
+
+func (pg PgRepo) SetPassword(ctx context.Context, userID int, passwordHash string) error {
+	_, err := pg.Pool.Exec(ctx, setPasswordQuery, userID, passwordHash)
+	return err
+}
+
+// ClaimUser sets password of account created before passwords were introduced, ErrConflict is returned if account
+// already has password
+func (pg PgRepo) ClaimUser(ctx context.Context, userID int, passwordHash string) error {
+	err := pg.Pool.QueryRow(ctx, claimUserQuery, userID, passwordHash).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return usecase.ErrConflict
+	}
+	return err
+}
+
+// RecordLoginFailure counts failed login and returns time account is locked until (zero if it's not locked)
+func (pg PgRepo) RecordLoginFailure(ctx context.Context, userID, maxFailed int, lockout time.Duration) (time.Time, error) {
+	var lockedUntil *time.Time
+	if err := pg.Pool.QueryRow(ctx, loginFailureQuery, userID, maxFailed, lockout.Seconds()).Scan(&lockedUntil); err != nil {
+		return time.Time{}, err
+	}
+	if lockedUntil == nil {
+		return time.Time{}, nil
+	}
+	return *lockedUntil, nil
+}
+
+func (pg PgRepo) ResetLoginFailures(ctx context.Context, userID int) error {
+	_, err := pg.Pool.Exec(ctx, resetFailuresQuery, userID)
+	return err
 }
@@ -3,24 +3,43 @@ package processor
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+	"github.com/vlasashk/websocket-chat/config"
 	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
 	"github.com/vlasashk/websocket-chat/pkg/kakafka"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
+// errInvalidEvent record can't be decoded or lacks required fields, it can never be applied
+var errInvalidEvent = errors.New("invalid event")
+
+// kinds of failures of dead-lettered records
+const (
+	failureInvalid  = "invalid"
+	failureRejected = "rejected"
+)
+
 type KafkaProc struct {
-	consumer *kakafka.Consumer
-	logger   zerolog.Logger
-	repo     usecase.Repo
+	consumer   *kakafka.Consumer
+	deadLetter *kakafka.DeadLetter
+	retry      config.RetryCfg
+	logger     zerolog.Logger
+	repo       usecase.Repo
 }
 
-func NewProcessor(consumer *kakafka.Consumer, logger zerolog.Logger, repo usecase.Repo) *KafkaProc {
+func NewProcessor(consumer *kakafka.Consumer, deadLetter *kakafka.DeadLetter, retry config.RetryCfg, logger zerolog.Logger,
+	repo usecase.Repo) *KafkaProc {
 	return &KafkaProc{
-		consumer: consumer,
-		logger:   logger,
-		repo:     repo,
+		consumer:   consumer,
+		deadLetter: deadLetter,
+		retry:      retry,
+		logger:     logger,
+		repo:       repo,
 	}
 }
 
@@ -33,30 +52,192 @@ func (p *KafkaProc) ProcessEvents(ctx context.Context) error {
 			if !ok {
 				return nil
 			}
-			var userMsg response.Msg
-			if err := json.Unmarshal(msg.Value, &userMsg); err != nil {
-				p.logger.Error().Err(err).Send()
-				if err = p.consumer.Commiter(ctx, msg); err != nil {
-					p.logger.Error().Err(err).Send()
-					return err
-				}
-				continue
-			}
-
-			if userMsg.UserID == 0 {
-				p.logger.Error().Msg("user ID was not provided in the message")
-				if err := p.consumer.Commiter(ctx, msg); err != nil {
-					return err
+			// record is committed once it's either applied or dead-lettered, otherwise it's fetched again after restart
+			if err := p.handle(ctx, msg); err != nil {
+				if ctx.Err() != nil {
+					return nil
 				}
-				continue
-			}
-
-			if err := p.repo.AddMessage(ctx, userMsg.UserID, userMsg.Text); err != nil {
-				p.logger.Error().Err(err).Send()
+				p.logger.Error().Err(err).Msg("failed to dead-letter record")
+				return err
 			}
 			if err := p.consumer.Commiter(ctx, msg); err != nil {
+				p.logger.Error().Err(err).Send()
 				return err
 			}
 		}
 	}
 }
+
+// handle applies record retrying transient failures, record which can never be applied is moved to dead-letter
+// topic to not block the partition
+func (p *KafkaProc) handle(ctx context.Context, msg kafka.Message) error {
+	attempts, err := p.apply(ctx, msg.Value)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	kind := failureRejected
+	if errors.Is(err, errInvalidEvent) {
+		kind = failureInvalid
+	}
+	p.logger.Error().Err(err).Str("kind", kind).Int("attempts", attempts).Int("partition", msg.Partition).
+		Int64("offset", msg.Offset).Msg("record is dead-lettered")
+	return p.deadLetter.Send(ctx, msg, err, kind, attempts)
+}
+
+// apply processes record with exponential backoff between attempts. Unavailable database (e.g. Postgres is down) is
+// retried until it recovers, so later records of the partition wait instead of being applied out of order. Other
+// failures (e.g. record referring to missing row) are retried STORAGE_RETRY_ATTEMPTS times, failures which can't be
+// fixed by retry are returned right away. Number of attempts made is returned
+func (p *KafkaProc) apply(ctx context.Context, data []byte) (int, error) {
+	delay := p.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := p.process(ctx, data)
+		switch {
+		case err == nil, errors.Is(err, errInvalidEvent), errors.Is(err, usecase.ErrRejected):
+			return attempt, err
+		case !errors.Is(err, usecase.ErrUnavailable) && attempt >= p.retry.Attempts:
+			return attempt, err
+		}
+
+		p.logger.Warn().Err(err).Int("attempt", attempt).Dur("delay", delay).Msg("failed to apply record, retrying")
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, p.retry.MaxBackoff)
+	}
+}
+
+// process dispatches single kafka record by its event type
+func (p *KafkaProc) process(ctx context.Context, data []byte) error {
+	var event response.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEvent, err)
+	}
+
+	switch event.Type {
+	case "":
+		// record written before events were introduced
+		return p.addMessage(ctx, data)
+	case response.EventMessage:
+		return p.addMessage(ctx, event.Payload)
+	case response.EventEdit:
+		return p.editMessage(ctx, event.Payload)
+	case response.EventDelete:
+		return p.deleteMessage(ctx, event.Payload)
+	case response.EventReaction:
+		return p.applyReaction(ctx, event.Payload)
+	case response.EventReceipt:
+		return p.saveReceipt(ctx, event.Payload)
+	default:
+		return fmt.Errorf("%w: unsupported event type %q", errInvalidEvent, event.Type)
+	}
+}
+
+func (p *KafkaProc) addMessage(ctx context.Context, data []byte) error {
+	var userMsg response.Msg
+	if err := json.Unmarshal(data, &userMsg); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEvent, err)
+	}
+
+	if userMsg.UserID == 0 {
+		return fmt.Errorf("%w: user ID was not provided in the message", errInvalidEvent)
+	}
+
+	if userMsg.ID == "" || userMsg.SentAt.IsZero() {
+		return fmt.Errorf("%w: message ID or timestamp was not provided in the message", errInvalidEvent)
+	}
+
+	if userMsg.Room == "" && userMsg.RecipientID == 0 {
+		return fmt.Errorf("%w: neither room nor recipient was provided in the message", errInvalidEvent)
+	}
+
+	// message sent before idempotency keys were introduced is keyed by its ID, as server does for keyless messages
+	if userMsg.IdempotencyKey == "" {
+		userMsg.IdempotencyKey = userMsg.ID
+	}
+
+	if err := p.repo.AddMessage(ctx, userMsg); err != nil {
+		if errors.Is(err, usecase.ErrConflict) {
+			p.logger.Warn().Str("message_id", userMsg.ID).Str("idempotency_key", userMsg.IdempotencyKey).Msg("duplicate message skipped")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *KafkaProc) editMessage(ctx context.Context, data []byte) error {
+	var edit response.MessageEdit
+	if err := json.Unmarshal(data, &edit); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEvent, err)
+	}
+
+	if edit.MessageID == "" || edit.UserID == 0 || edit.EditedAt.IsZero() {
+		return fmt.Errorf("%w: message ID, user ID or edit time was not provided in the edit", errInvalidEvent)
+	}
+
+	if err := p.repo.EditMessage(ctx, edit); err != nil {
+		if errors.Is(err, usecase.ErrNotFound) {
+			p.logger.Warn().Str("message_id", edit.MessageID).Int("user_id", edit.UserID).Msg("edit of unknown message or stale edit skipped")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *KafkaProc) deleteMessage(ctx context.Context, data []byte) error {
+	var del response.MessageDelete
+	if err := json.Unmarshal(data, &del); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEvent, err)
+	}
+
+	if del.MessageID == "" || del.UserID == 0 || del.DeletedAt.IsZero() {
+		return fmt.Errorf("%w: message ID, user ID or deletion time was not provided in the deletion", errInvalidEvent)
+	}
+
+	if err := p.repo.DeleteMessage(ctx, del); err != nil {
+		if errors.Is(err, usecase.ErrNotFound) {
+			p.logger.Warn().Str("message_id", del.MessageID).Int("user_id", del.UserID).Msg("deletion of unknown or already deleted message skipped")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *KafkaProc) applyReaction(ctx context.Context, data []byte) error {
+	var reaction response.MessageReaction
+	if err := json.Unmarshal(data, &reaction); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEvent, err)
+	}
+
+	if reaction.MessageID == "" || reaction.UserID == 0 || reaction.Emoji == "" {
+		return fmt.Errorf("%w: message ID, user ID or emoji was not provided in the reaction", errInvalidEvent)
+	}
+
+	return p.repo.ApplyReaction(ctx, reaction)
+}
+
+func (p *KafkaProc) saveReceipt(ctx context.Context, data []byte) error {
+	var receipt response.Receipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEvent, err)
+	}
+
+	if receipt.MessageID == "" || receipt.UserID == 0 || receipt.Room == "" || receipt.At.IsZero() {
+		return fmt.Errorf("%w: message ID, user ID, room or time was not provided in the receipt", errInvalidEvent)
+	}
+
+	if receipt.Kind != response.ReceiptDelivered && receipt.Kind != response.ReceiptRead {
+		return fmt.Errorf("%w: unsupported receipt kind %q", errInvalidEvent, receipt.Kind)
+	}
+
+	return p.repo.SaveReceipt(ctx, receipt)
+}
@@ -0,0 +1,237 @@
+package httpchi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/config"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+	"github.com/vlasashk/websocket-chat/pkg/utils"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountLocked      = errors.New("account is locked")
+)
+
+// RegisterUser creates account with password
+func RegisterUser(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userReq response.RegisterReq
+		if err := render.DecodeJSON(r.Body, &userReq); err != nil {
+			log.Error().Err(err).Msg("error decoding body")
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad json"})
+			return
+		}
+
+		if length := utf8.RuneCountInString(utils.CanonicalUsername(userReq.Username)); length == 0 || length > 50 {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "username length is not supported"})
+			return
+		}
+
+		hash, err := auth.HashPassword(userReq.Password)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: err.Error()})
+			return
+		}
+
+		user, err := repo.CreateUser(ctx, userReq.Username, hash)
+		if err != nil {
+			if errors.Is(err, usecase.ErrConflict) {
+				render.Status(r, http.StatusConflict)
+				render.JSON(w, r, response.ErrResp{Error: "username is already taken"})
+				return
+			}
+			log.Error().Err(err).Msg("error adding user")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to register"})
+			return
+		}
+
+		resp := response.RegisterResp{UserID: user.UserID}
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, resp)
+	}
+}
+
+// Login checks password and issues signed session token used to authenticate WS connection
+func Login(ctx context.Context, repo usecase.Repo, signer *auth.Signer, cfg config.AuthCfg) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var loginReq response.LoginReq
+		if err := render.DecodeJSON(r.Body, &loginReq); err != nil {
+			log.Error().Err(err).Msg("error decoding body")
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad json"})
+			return
+		}
+
+		user, err := verifyCredentials(ctx, repo, cfg, loginReq.Username, loginReq.Password)
+		if err != nil {
+			renderAuthErr(w, r, err)
+			return
+		}
+
+		token, err := signer.Sign(auth.Claims{
+			UserID:    user.UserID,
+			Username:  user.Username,
+			Moderator: user.Moderator,
+			Version:   user.TokenVersion,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("error signing token")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to login"})
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, response.LoginResp{UserID: user.UserID, Token: token})
+	}
+}
+
+// ClaimUser sets the first password of account created before passwords were introduced, such account can't log in
+// until then. Only service token may claim account
+func ClaimUser(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !claimsFrom(r).Service {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, response.ErrResp{Error: "account can be claimed only by service"})
+			return
+		}
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || userID <= 0 {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad user id"})
+			return
+		}
+
+		var claimReq response.ClaimReq
+		if err = render.DecodeJSON(r.Body, &claimReq); err != nil {
+			log.Error().Err(err).Msg("error decoding body")
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad json"})
+			return
+		}
+		hash, err := auth.HashPassword(claimReq.Password)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: err.Error()})
+			return
+		}
+
+		if _, err = repo.GetUserByID(ctx, userID); err != nil {
+			renderUser(w, r, response.User{}, err)
+			return
+		}
+		if err = repo.ClaimUser(ctx, userID, hash); err != nil {
+			if errors.Is(err, usecase.ErrConflict) {
+				render.Status(r, http.StatusConflict)
+				render.JSON(w, r, response.ErrResp{Error: "account already has password"})
+				return
+			}
+			log.Error().Err(err).Msg("error claiming user")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to claim account"})
+			return
+		}
+
+		render.NoContent(w, r)
+	}
+}
+
+// ChangePassword replaces password of account, current password is required. Tokens issued before are revoked
+func ChangePassword(ctx context.Context, repo usecase.Repo, cfg config.AuthCfg) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var changeReq response.ChangePasswordReq
+		if err := render.DecodeJSON(r.Body, &changeReq); err != nil {
+			log.Error().Err(err).Msg("error decoding body")
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad json"})
+			return
+		}
+
+		hash, err := auth.HashPassword(changeReq.NewPassword)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: err.Error()})
+			return
+		}
+
+		user, err := verifyCredentials(ctx, repo, cfg, changeReq.Username, changeReq.Password)
+		if err != nil {
+			renderAuthErr(w, r, err)
+			return
+		}
+
+		if err = repo.SetPassword(ctx, user.UserID, hash); err != nil {
+			log.Error().Err(err).Msg("error setting password")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to change password"})
+			return
+		}
+
+		render.NoContent(w, r)
+	}
+}
+
+// verifyCredentials checks password of account, counting failures and locking account after too many of them
+func verifyCredentials(ctx context.Context, repo usecase.Repo, cfg config.AuthCfg, username, password string) (response.User, error) {
+	creds, err := repo.GetCredentials(ctx, username)
+	if err != nil {
+		if errors.Is(err, usecase.ErrNotFound) {
+			return response.User{}, errInvalidCredentials
+		}
+		return response.User{}, err
+	}
+
+	if time.Now().Before(creds.LockedUntil) {
+		return response.User{}, errAccountLocked
+	}
+
+	if creds.PasswordHash == "" || !auth.CheckPassword(creds.PasswordHash, password) {
+		lockedUntil, err := repo.RecordLoginFailure(ctx, creds.User.UserID, cfg.MaxFailedLogins, cfg.LockoutDuration)
+		if err != nil {
+			return response.User{}, err
+		}
+		if time.Now().Before(lockedUntil) {
+			log.Warn().Int("user_id", creds.User.UserID).Time("locked_until", lockedUntil).Msg("account locked")
+			return response.User{}, errAccountLocked
+		}
+		return response.User{}, errInvalidCredentials
+	}
+
+	if creds.FailedLogins > 0 {
+		if err = repo.ResetLoginFailures(ctx, creds.User.UserID); err != nil {
+			return response.User{}, err
+		}
+	}
+
+	return creds.User, nil
+}
+
+func renderAuthErr(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, response.ErrResp{Error: err.Error()})
+	case errors.Is(err, errAccountLocked):
+		render.Status(r, http.StatusLocked)
+		render.JSON(w, r, response.ErrResp{Error: err.Error()})
+	default:
+		log.Error().Err(err).Msg("error verifying credentials")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, response.ErrResp{Error: "failed to verify credentials"})
+	}
+}
@@ -0,0 +1,242 @@
+package httpchi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const (
+	// maxPageSize upper bound of messages returned in single page
+	maxPageSize     = 100
+	defaultPageSize = 50
+)
+
+// GetMessage looks up stored message by its ID
+func GetMessage(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad message id"})
+			return
+		}
+
+		msg, err := repo.GetMessage(ctx, messageID.String())
+		if err == nil && !canSee(claimsFrom(r), msg) {
+			// direct message of other users is not disclosed
+			err = usecase.ErrNotFound
+		}
+		switch {
+		case errors.Is(err, usecase.ErrNotFound):
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.ErrResp{Error: "message not found"})
+		case err != nil:
+			log.Error().Err(err).Msg("error getting message")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get message"})
+		default:
+			render.JSON(w, r, msg)
+		}
+	}
+}
+
+// GetRoomHistory returns page of room messages sent before message passed in before query parameter,
+// the latest messages are returned if it's omitted. Messages following sequence number passed in after_seq query
+// parameter are returned instead if it's set. Page size is set by limit query parameter
+func GetRoomHistory(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var before string
+		if raw := query.Get("before"); raw != "" {
+			messageID, err := uuid.Parse(raw)
+			if err != nil {
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.ErrResp{Error: "bad message id"})
+				return
+			}
+			before = messageID.String()
+		}
+
+		var afterSeq int64
+		if raw := query.Get("after_seq"); raw != "" {
+			var err error
+			afterSeq, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil || afterSeq < 0 || before != "" {
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.ErrResp{Error: "after_seq must be non-negative number and can't be combined with before"})
+				return
+			}
+		}
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "limit must be from 1 to " + strconv.Itoa(maxPageSize)})
+			return
+		}
+
+		var messages []response.Msg
+		if query.Has("after_seq") {
+			messages, err = repo.GetRoomSince(ctx, chi.URLParam(r, "room"), afterSeq, limit)
+		} else {
+			messages, err = repo.GetRoomHistory(ctx, chi.URLParam(r, "room"), before, limit)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("error getting room history")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get room history"})
+			return
+		}
+		render.JSON(w, r, messages)
+	}
+}
+
+// GetReactions returns stored reactions of the message. Message which isn't stored (yet) has none
+func GetReactions(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad message id"})
+			return
+		}
+
+		msg, err := repo.GetMessage(ctx, messageID.String())
+		if err == nil && !canSee(claimsFrom(r), msg) {
+			// direct message of other users is not disclosed
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.ErrResp{Error: "message not found"})
+			return
+		}
+		var reactions []response.MessageReaction
+		if err == nil || errors.Is(err, usecase.ErrNotFound) {
+			reactions, err = repo.GetReactions(ctx, messageID.String())
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("error getting reactions")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get reactions"})
+			return
+		}
+		render.JSON(w, r, reactions)
+	}
+}
+
+// GetRoom returns stored state of the room, room without messages is reported with zero sequence number. State is
+// returned only after events which were in Kafka at the time of request are applied, so server seeding its sequence
+// counter from it doesn't reuse numbers of messages on their way to storage
+func GetRoom(ctx context.Context, repo usecase.Repo, lag usecase.Lag,
+	drainTimeout time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := lag.WaitDrained(r.Context(), drainTimeout); err != nil {
+			log.Error().Err(err).Msg("kafka events are not applied yet")
+			render.Status(r, http.StatusServiceUnavailable)
+			render.JSON(w, r, response.ErrResp{Error: "room state is not up to date"})
+			return
+		}
+
+		room := chi.URLParam(r, "room")
+		seq, err := repo.GetLastSeq(ctx, room)
+		if err != nil {
+			log.Error().Err(err).Msg("error getting room sequence")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get room"})
+			return
+		}
+		render.JSON(w, r, response.RoomInfo{Room: room, LastSeq: seq})
+	}
+}
+
+// GetMessages returns page of stored messages, the newest first. Messages are filtered by room, user_id and sent time
+// range (since inclusive, until exclusive, RFC 3339), cursor is next_cursor of the previous page. Direct messages are
+// visible to their participants only, service may pass the user it acts for in viewer_id
+func GetMessages(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := messageFilter(r)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: err.Error()})
+			return
+		}
+
+		// one extra message tells whether there is the next page
+		limit := filter.Limit
+		filter.Limit++
+		messages, err := repo.FindMessages(ctx, filter)
+		if err != nil {
+			log.Error().Err(err).Msg("error finding messages")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get messages"})
+			return
+		}
+
+		page := response.MessagePage{Messages: messages}
+		if len(messages) > limit {
+			page.Messages = messages[:limit]
+			page.NextCursor = page.Messages[limit-1].ID
+		}
+		render.JSON(w, r, page)
+	}
+}
+
+// messageFilter parses query parameters of messages request. Token owner is the viewer unless it's service
+func messageFilter(r *http.Request) (usecase.MessageFilter, error) {
+	query := r.URL.Query()
+	filter := usecase.MessageFilter{Room: query.Get("room"), Limit: defaultPageSize}
+
+	for param, dst := range map[string]*int{"user_id": &filter.UserID, "viewer_id": &filter.ViewerID} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		userID, err := strconv.Atoi(raw)
+		if err != nil || userID <= 0 {
+			return usecase.MessageFilter{}, fmt.Errorf("bad %s", param)
+		}
+		*dst = userID
+	}
+	if claims := claimsFrom(r); !claims.Service {
+		filter.ViewerID = claims.UserID
+	}
+
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return usecase.MessageFilter{}, fmt.Errorf("%s must be RFC 3339 time", param)
+		}
+		*dst = t
+	}
+
+	if raw := query.Get("cursor"); raw != "" {
+		messageID, err := uuid.Parse(raw)
+		if err != nil {
+			return usecase.MessageFilter{}, errors.New("bad cursor")
+		}
+		filter.Before = messageID.String()
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return usecase.MessageFilter{}, fmt.Errorf("limit must be from 1 to %d", maxPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
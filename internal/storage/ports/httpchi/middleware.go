@@ -0,0 +1,78 @@
+package httpchi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+type claimsKey struct{}
+
+// Authenticated rejects requests without valid session or service token, claims of the token are passed in request context
+func Authenticated(signer *auth.Signer, repo usecase.Repo) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := auth.FromRequest(r)
+			if err != nil {
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, response.ErrResp{Error: "unauthorized"})
+				return
+			}
+
+			claims, err := signer.Parse(token)
+			if err != nil {
+				log.Warn().Err(err).Str("remote_addr", r.RemoteAddr).Msg("invalid token")
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, response.ErrResp{Error: "unauthorized"})
+				return
+			}
+			if err = checkRevoked(r.Context(), repo, claims); err != nil {
+				if errors.Is(err, auth.ErrTokenRevoked) {
+					log.Warn().Err(err).Int("user_id", claims.UserID).Msg("revoked token")
+					render.Status(r, http.StatusUnauthorized)
+					render.JSON(w, r, response.ErrResp{Error: "unauthorized"})
+					return
+				}
+				log.Error().Err(err).Msg("error checking token version")
+				render.Status(r, http.StatusInternalServerError)
+				render.JSON(w, r, response.ErrResp{Error: "failed to verify token"})
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// checkRevoked reports auth.ErrTokenRevoked if password of token owner was changed after the token was issued or
+// the account is missing
+func checkRevoked(ctx context.Context, repo usecase.Repo, claims auth.Claims) error {
+	if claims.Service {
+		return nil
+	}
+	user, err := repo.GetUserByID(ctx, claims.UserID)
+	if errors.Is(err, usecase.ErrNotFound) {
+		return auth.ErrTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+	return claims.CheckVersion(user.TokenVersion)
+}
+
+// claimsFrom returns claims of authenticated request
+func claimsFrom(r *http.Request) auth.Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(auth.Claims)
+	return claims
+}
+
+// canSee reports whether direct message is visible to token owner, room messages are visible to everyone
+func canSee(claims auth.Claims, msg response.Msg) bool {
+	return claims.Service || msg.RecipientID == 0 || claims.UserID == msg.UserID || claims.UserID == msg.RecipientID
+}
@@ -0,0 +1,61 @@
+package httpchi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+// GetReadState returns read position of the user in the room with number of unread messages
+func GetReadState(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || userID <= 0 {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad user id"})
+			return
+		}
+		if claims := claimsFrom(r); !claims.Service && claims.UserID != userID {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, response.ErrResp{Error: "read state of another user"})
+			return
+		}
+
+		state, err := repo.GetReadState(ctx, userID, chi.URLParam(r, "room"))
+		if err != nil {
+			log.Error().Err(err).Msg("error getting read state")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get read state"})
+			return
+		}
+		render.JSON(w, r, state)
+	}
+}
+
+// GetReadBy lists users who have read the room up to message passed in message_id query parameter
+func GetReadBy(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messageID, err := uuid.Parse(r.URL.Query().Get("message_id"))
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad message id"})
+			return
+		}
+
+		markers, err := repo.GetReadBy(ctx, chi.URLParam(r, "room"), messageID.String())
+		if err != nil {
+			log.Error().Err(err).Msg("error getting read markers")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to get read markers"})
+			return
+		}
+		render.JSON(w, r, markers)
+	}
+}
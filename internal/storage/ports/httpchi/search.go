@@ -0,0 +1,63 @@
+package httpchi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+const maxSearchQueryLen = 200
+
+// SearchMessages runs full-text search of terms passed in q query parameter, the most relevant messages first.
+// Results are filtered same as GetMessages and paged by offset (next_offset of the previous page)
+func SearchMessages(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text := r.URL.Query().Get("q")
+		if length := utf8.RuneCountInString(text); length == 0 || length > maxSearchQueryLen {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "search query length is not supported"})
+			return
+		}
+
+		filter, err := messageFilter(r)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: err.Error()})
+			return
+		}
+
+		var offset int
+		if raw := r.URL.Query().Get("offset"); raw != "" {
+			offset, err = strconv.Atoi(raw)
+			if err != nil || offset < 0 {
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.ErrResp{Error: "bad offset"})
+				return
+			}
+		}
+
+		// one extra hit tells whether there is the next page
+		limit := filter.Limit
+		filter.Limit++
+		hits, err := repo.SearchMessages(ctx, text, filter, offset)
+		if err != nil {
+			log.Error().Err(err).Msg("error searching messages")
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.ErrResp{Error: "failed to search messages"})
+			return
+		}
+
+		page := response.SearchPage{Results: hits}
+		if len(hits) > limit {
+			page.Results = hits[:limit]
+			page.NextOffset = offset + limit
+		}
+		render.JSON(w, r, page)
+	}
+}
@@ -2,8 +2,10 @@ package httpchi
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -11,10 +13,11 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/vlasashk/websocket-chat/config"
 	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
 	"github.com/vlasashk/websocket-chat/pkg/response"
 )
 
-func New(ctx context.Context, cfg config.StorageAddr, repo usecase.Repo) *http.Server {
+func New(ctx context.Context, cfg config.StorageConfig, repo usecase.Repo, lag usecase.Lag, signer *auth.Signer) *http.Server {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -25,9 +28,25 @@ func New(ctx context.Context, cfg config.StorageAddr, repo usecase.Repo) *http.S
 
 	r.Get("/healthz", HealthCheck)
 	r.Post("/register", RegisterUser(ctx, repo))
+	r.Post("/login", Login(ctx, repo, signer, cfg.Auth))
+	r.Post("/password", ChangePassword(ctx, repo, cfg.Auth))
+	r.Group(func(r chi.Router) {
+		r.Use(Authenticated(signer, repo))
+		r.Get("/users", GetUserByName(ctx, repo))
+		r.Get("/users/{id}", GetUserByID(ctx, repo))
+		r.Put("/users/{id}/password", ClaimUser(ctx, repo))
+		r.Get("/users/{id}/reads/{room}", GetReadState(ctx, repo))
+		r.Get("/messages", GetMessages(ctx, repo))
+		r.Get("/messages/search", SearchMessages(ctx, repo))
+		r.Get("/messages/{id}", GetMessage(ctx, repo))
+		r.Get("/messages/{id}/reactions", GetReactions(ctx, repo))
+		r.Get("/rooms/{room}", GetRoom(ctx, repo, lag, cfg.DrainTimeout))
+		r.Get("/rooms/{room}/messages", GetRoomHistory(ctx, repo))
+		r.Get("/rooms/{room}/reads", GetReadBy(ctx, repo))
+	})
 
 	return &http.Server{
-		Addr:    net.JoinHostPort(cfg.Host, cfg.Port),
+		Addr:    net.JoinHostPort(cfg.HTTP.Host, cfg.HTTP.Port),
 		Handler: r,
 	}
 }
@@ -38,26 +57,45 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func RegisterUser(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+// GetUserByName looks up account by username passed in username query parameter, matching is case-insensitive
+func GetUserByName(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var userReq response.RegisterReq
-		if err := render.DecodeJSON(r.Body, &userReq); err != nil {
-			log.Error().Err(err).Msg("error decoding body")
+		username := r.URL.Query().Get("username")
+		if username == "" {
 			render.Status(r, http.StatusBadRequest)
-			render.JSON(w, r, response.ErrResp{Error: "bad json"})
+			render.JSON(w, r, response.ErrResp{Error: "username is not specified"})
 			return
 		}
 
-		userID, err := repo.AddUser(ctx, userReq.Username)
-		if err != nil {
-			log.Error().Err(err).Msg("error decoding body")
-			render.Status(r, http.StatusInternalServerError)
-			render.JSON(w, r, response.ErrResp{Error: "failed to register"})
+		user, err := repo.GetUserByName(ctx, username)
+		renderUser(w, r, user, err)
+	}
+}
+
+func GetUserByID(ctx context.Context, repo usecase.Repo) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil || userID <= 0 {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ErrResp{Error: "bad user id"})
 			return
 		}
 
-		resp := response.RegisterResp{UserID: userID}
-		render.Status(r, http.StatusCreated)
-		render.JSON(w, r, resp)
+		user, err := repo.GetUserByID(ctx, userID)
+		renderUser(w, r, user, err)
+	}
+}
+
+func renderUser(w http.ResponseWriter, r *http.Request, user response.User, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrNotFound):
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, response.ErrResp{Error: "user not found"})
+	case err != nil:
+		log.Error().Err(err).Msg("error getting user")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, response.ErrResp{Error: "failed to get user"})
+	default:
+		render.JSON(w, r, user)
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/vlasashk/websocket-chat/internal/storage/adapters/pgrepo"
 	"github.com/vlasashk/websocket-chat/internal/storage/ports/httpchi"
 	"github.com/vlasashk/websocket-chat/internal/storage/usecase"
+	"github.com/vlasashk/websocket-chat/pkg/auth"
 	"github.com/vlasashk/websocket-chat/pkg/kakafka"
 	"github.com/vlasashk/websocket-chat/pkg/logger"
 )
@@ -25,6 +26,8 @@ type Container struct {
 	httpServ    *resource[*http.Server]
 	pgRepo      *resource[usecase.Repo]
 	kafkaReader *resource[*kakafka.Consumer]
+	deadLetter  *resource[*kakafka.DeadLetter]
+	lag         *resource[*kakafka.Lag]
 }
 
 func New() *Container {
@@ -33,6 +36,8 @@ func New() *Container {
 		httpServ:    &resource[*http.Server]{},
 		pgRepo:      &resource[usecase.Repo]{},
 		kafkaReader: &resource[*kakafka.Consumer]{},
+		deadLetter:  &resource[*kakafka.DeadLetter]{},
+		lag:         &resource[*kakafka.Lag]{},
 	}
 }
 
@@ -52,8 +57,17 @@ func (r *Container) GetHttp(ctx context.Context, cfg config.StorageConfig) (*htt
 		return nil, err
 	}
 
+	lag, err := r.GetLag(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return r.httpServ.get(func() (*http.Server, error) {
-		return httpchi.New(ctx, cfg.HTTP, repo), nil
+		signer, err := auth.NewSigner(cfg.Auth)
+		if err != nil {
+			return nil, err
+		}
+		return httpchi.New(ctx, cfg, repo, lag, signer), nil
 	})
 }
 
@@ -88,3 +102,15 @@ func (r *Container) GetKafkaConsumer(ctx context.Context, cfg config.StorageConf
 		return kakafka.NewConsumer(ctx, log, cfg.Kafka), nil
 	})
 }
+
+func (r *Container) GetDeadLetter(cfg config.StorageConfig) (*kakafka.DeadLetter, error) {
+	return r.deadLetter.get(func() (*kakafka.DeadLetter, error) {
+		return kakafka.NewDeadLetter(cfg.Kafka), nil
+	})
+}
+
+func (r *Container) GetLag(cfg config.StorageConfig) (*kakafka.Lag, error) {
+	return r.lag.get(func() (*kakafka.Lag, error) {
+		return kakafka.NewLag(cfg.Kafka), nil
+	})
+}
@@ -39,11 +39,20 @@ func Run(ctx context.Context, cfg config.StorageConfig) error {
 	if err != nil {
 		return err
 	}
+	deadLetter, err := container.GetDeadLetter(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := deadLetter.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close dead-letter writer")
+		}
+	}()
 
 	g.Go(kafkaConsumer.Run)
 	g.Go(func() error {
 		log.Info().Msg("starting processing kafka events")
-		return processor.NewProcessor(kafkaConsumer, log, repo).ProcessEvents(gCtx)
+		return processor.NewProcessor(kafkaConsumer, deadLetter, cfg.Retry, log, repo).ProcessEvents(gCtx)
 	})
 	g.Go(func() error {
 		log.Info().Msg(fmt.Sprintf("starting server: %s", net.JoinHostPort(cfg.HTTP.Host, cfg.HTTP.Port)))
@@ -1,7 +1,15 @@
 package usecase
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Processor interface {
 	ProcessEvents(ctx context.Context) error
 }
+
+// Lag tells whether events already in Kafka are applied
+type Lag interface {
+	WaitDrained(ctx context.Context, timeout time.Duration) error
+}
@@ -2,9 +2,64 @@ package usecase
 
 import (
 	"context"
+	"errors"
+	"time"
+
+	"github.com/vlasashk/websocket-chat/pkg/response"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+	// ErrRejected database refused data (invalid value or violated constraint), so repeating the write is pointless
+	ErrRejected = errors.New("rejected by database")
+	// ErrNoReference data refers to missing row (e.g. reaction to message which isn't stored yet)
+	ErrNoReference = errors.New("referenced row is missing")
+	// ErrUnavailable database can't be reached or can't serve request for now (e.g. it's down or overloaded)
+	ErrUnavailable = errors.New("database is unavailable")
 )
 
+// Credentials account with its password hash and login failures state
+type Credentials struct {
+	User         response.User
+	PasswordHash string
+	FailedLogins int
+	LockedUntil  time.Time
+}
+
+// MessageFilter selects stored messages, zero fields don't filter. Messages are paged from the newest one sent
+// before message with ID Before. Direct messages are visible only to their participants if ViewerID is set
+type MessageFilter struct {
+	Room     string
+	UserID   int
+	Since    time.Time
+	Until    time.Time
+	Before   string
+	Limit    int
+	ViewerID int
+}
+
 type Repo interface {
-	AddMessage(ctx context.Context, userID int, msg string) error
-	AddUser(ctx context.Context, UserName string) (int, error)
+	AddMessage(ctx context.Context, msg response.Msg) error
+	GetMessage(ctx context.Context, messageID string) (response.Msg, error)
+	GetRoomHistory(ctx context.Context, room, before string, limit int) ([]response.Msg, error)
+	GetRoomSince(ctx context.Context, room string, after int64, limit int) ([]response.Msg, error)
+	GetLastSeq(ctx context.Context, room string) (int64, error)
+	FindMessages(ctx context.Context, filter MessageFilter) ([]response.Msg, error)
+	SearchMessages(ctx context.Context, text string, filter MessageFilter, offset int) ([]response.SearchHit, error)
+	EditMessage(ctx context.Context, edit response.MessageEdit) error
+	DeleteMessage(ctx context.Context, del response.MessageDelete) error
+	ApplyReaction(ctx context.Context, reaction response.MessageReaction) error
+	GetReactions(ctx context.Context, messageID string) ([]response.MessageReaction, error)
+	SaveReceipt(ctx context.Context, receipt response.Receipt) error
+	GetReadState(ctx context.Context, userID int, room string) (response.ReadState, error)
+	GetReadBy(ctx context.Context, room, messageID string) ([]response.ReadMarker, error)
+	CreateUser(ctx context.Context, username, passwordHash string) (response.User, error)
+	GetUserByID(ctx context.Context, userID int) (response.User, error)
+	GetUserByName(ctx context.Context, username string) (response.User, error)
+	GetCredentials(ctx context.Context, username string) (Credentials, error)
+	SetPassword(ctx context.Context, userID int, passwordHash string) error
+	ClaimUser(ctx context.Context, userID int, passwordHash string) error
+	RecordLoginFailure(ctx context.Context, userID, maxFailed int, lockout time.Duration) (time.Time, error)
+	ResetLoginFailures(ctx context.Context, userID int) error
 }
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS room VARCHAR(50) NOT NULL DEFAULT 'general';
+
+CREATE INDEX IF NOT EXISTS messages_room_idx ON messages (room, message_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS messages_room_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS room;
+-- +goose StatementEnd
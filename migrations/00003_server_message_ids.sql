@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE messages ALTER COLUMN message_id DROP DEFAULT;
+ALTER TABLE messages ALTER COLUMN message_id TYPE UUID USING lpad(to_hex(message_id), 32, '0')::UUID;
+DROP SEQUENCE IF EXISTS messages_message_id_seq;
+
+ALTER TABLE messages ALTER COLUMN sent_at DROP DEFAULT;
+ALTER TABLE messages ALTER COLUMN sent_at TYPE TIMESTAMPTZ USING sent_at AT TIME ZONE 'UTC';
+ALTER TABLE messages ALTER COLUMN sent_at SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE messages ALTER COLUMN sent_at DROP NOT NULL;
+ALTER TABLE messages ALTER COLUMN sent_at TYPE TIMESTAMP USING sent_at AT TIME ZONE 'UTC';
+ALTER TABLE messages ALTER COLUMN sent_at SET DEFAULT CURRENT_TIMESTAMP;
+
+ALTER TABLE messages DROP COLUMN message_id;
+ALTER TABLE messages ADD COLUMN message_id SERIAL PRIMARY KEY;
+CREATE INDEX IF NOT EXISTS messages_room_idx ON messages (room, message_id);
+-- +goose StatementEnd
@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pressly/goose/v3"
+	"github.com/vlasashk/websocket-chat/pkg/utils"
+)
+
+func init() {
+	goose.AddMigrationContext(upUniqueUsernames, downUniqueUsernames)
+}
+
+// upUniqueUsernames keys accounts by username the same way storage service matches them, so the key is computed in Go
+// rather than approximated by SQL functions
+func upUniqueUsernames(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS username_key VARCHAR(200);`); err != nil {
+		return err
+	}
+
+	keys, err := usernameKeys(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for userID, key := range keys {
+		if _, err = tx.ExecContext(ctx, `UPDATE users SET username_key = $2 WHERE user_id = $1;`, userID, key); err != nil {
+			return err
+		}
+	}
+
+	// merge accounts sharing the key (e.g. created per connection) into the oldest one, so the result doesn't depend
+	// on order of rows
+	_, err = tx.ExecContext(ctx, `
+		UPDATE messages m
+		SET user_id = d.keep_id
+		FROM (SELECT user_id, min(user_id) OVER (PARTITION BY username_key) AS keep_id FROM users) d
+		WHERE m.user_id = d.user_id AND d.user_id <> d.keep_id;
+
+		DELETE FROM users u
+		USING (SELECT user_id, min(user_id) OVER (PARTITION BY username_key) AS keep_id FROM users) d
+		WHERE u.user_id = d.user_id AND d.user_id <> d.keep_id;
+
+		ALTER TABLE users ALTER COLUMN username_key SET NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS users_username_key_idx ON users (username_key);`)
+	return err
+}
+
+// usernameKeys computes key of each account with utils.UsernameKey
+func usernameKeys(ctx context.Context, tx *sql.Tx) (map[int]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT user_id, username FROM users;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[int]string)
+	for rows.Next() {
+		var userID int
+		var username string
+		if err = rows.Scan(&userID, &username); err != nil {
+			return nil, err
+		}
+		keys[userID] = utils.UsernameKey(username)
+	}
+	return keys, rows.Err()
+}
+
+func downUniqueUsernames(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		DROP INDEX IF EXISTS users_username_key_idx;
+		ALTER TABLE users DROP COLUMN IF EXISTS username_key;`)
+	return err
+}
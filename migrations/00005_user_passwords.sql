@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- accounts created before passwords were introduced have NULL hash until claimed by service
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
+-- session tokens carry version they were issued with, changing password increments it and revokes older tokens
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS token_version;
+ALTER TABLE users DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE users DROP COLUMN IF EXISTS failed_logins;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- direct message has recipient instead of room
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS recipient_id INTEGER REFERENCES users(user_id);
+ALTER TABLE messages ALTER COLUMN room DROP NOT NULL;
+ALTER TABLE messages ADD CONSTRAINT messages_room_or_recipient CHECK ((room IS NULL) <> (recipient_id IS NULL));
+
+CREATE INDEX IF NOT EXISTS messages_recipient_idx ON messages (recipient_id, message_id) WHERE recipient_id IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS messages_recipient_idx;
+DELETE FROM messages WHERE recipient_id IS NOT NULL;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_room_or_recipient;
+ALTER TABLE messages ALTER COLUMN room SET NOT NULL;
+ALTER TABLE messages DROP COLUMN IF EXISTS recipient_id;
+-- +goose StatementEnd
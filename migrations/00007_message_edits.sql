@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
+
+-- prior revisions of edited messages kept for audit
+CREATE TABLE IF NOT EXISTS message_edits (
+    edit_id SERIAL PRIMARY KEY,
+    message_id UUID NOT NULL REFERENCES messages(message_id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    replaced_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS message_edits_message_idx ON message_edits (message_id, edit_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS message_edits;
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
+-- +goose StatementEnd
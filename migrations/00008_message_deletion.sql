@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- moderators are appointed manually: UPDATE users SET is_moderator = true WHERE username_key = '...'
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_moderator BOOLEAN NOT NULL DEFAULT false;
+
+-- deleted messages are kept for audit, deleted_by is either author or moderator
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by INTEGER REFERENCES users(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE users DROP COLUMN IF EXISTS is_moderator;
+-- +goose StatementEnd
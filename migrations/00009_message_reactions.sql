@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id UUID NOT NULL REFERENCES messages(message_id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(user_id),
+    emoji VARCHAR(32) NOT NULL,
+    reacted_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS message_reactions;
+-- +goose StatementEnd
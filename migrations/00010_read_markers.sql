@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- markers only move forward, message IDs are time ordered
+CREATE TABLE IF NOT EXISTS read_markers (
+    user_id INTEGER NOT NULL REFERENCES users(user_id),
+    room VARCHAR(50) NOT NULL,
+    last_delivered UUID,
+    last_read UUID,
+    updated_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, room)
+);
+
+CREATE INDEX IF NOT EXISTS read_markers_room_idx ON read_markers (room, last_read);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS read_markers;
+-- +goose StatementEnd
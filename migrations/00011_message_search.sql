@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- simple configuration doesn't stem words, chat is not bound to single language
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_tsv TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED;
+
+CREATE INDEX IF NOT EXISTS messages_content_tsv_idx ON messages USING GIN (content_tsv);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS messages_content_tsv_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS content_tsv;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- seq orders messages of the room, direct messages have none
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT;
+
+UPDATE messages m SET seq = numbered.seq
+FROM (
+    SELECT message_id, row_number() OVER (PARTITION BY room ORDER BY message_id) AS seq
+    FROM messages
+    WHERE room IS NOT NULL
+) numbered
+WHERE m.message_id = numbered.message_id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS messages_room_seq_idx ON messages (room, seq);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS messages_room_seq_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS seq;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- key is chosen by sending client (message ID if it has none), so it's unique per author only
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(64);
+UPDATE messages SET idempotency_key = message_id::text WHERE idempotency_key IS NULL;
+ALTER TABLE messages ALTER COLUMN idempotency_key SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS messages_idempotency_key_idx ON messages (user_id, idempotency_key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS messages_idempotency_key_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS idempotency_key;
+-- +goose StatementEnd
@@ -42,3 +42,22 @@ func Down(pool *pgxpool.Pool, path string) error {
 
 	return nil
 }
+
+// Reset rolls back all applied migrations
+func Reset(pool *pgxpool.Pool, path string) error {
+	if err := goose.SetDialect("postgres"); err != nil {
+		return err
+	}
+
+	db := stdlib.OpenDBFromPool(pool)
+
+	if err := goose.Reset(db, path); err != nil {
+		return err
+	}
+
+	if err := db.Close(); err != nil {
+		log.Error().Err(err).Send()
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLen = 8
+	// bcrypt ignores everything beyond 72 bytes
+	maxPasswordBytes = 72
+)
+
+var ErrWeakPassword = errors.New("password must be 8 to 72 bytes long")
+
+func HashPassword(password string) (string, error) {
+	if utf8.RuneCountInString(password) < minPasswordLen || len(password) > maxPasswordBytes {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches bcrypt hash
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
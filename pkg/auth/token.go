@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vlasashk/websocket-chat/config"
+)
+
+const (
+	// TokenQueryParam query parameter to pass token where headers can't be set (e.g. browser WS)
+	TokenQueryParam = "token"
+	// serviceSubject subject of tokens issued to internal services
+	serviceSubject = "service"
+)
+
+var (
+	ErrNoToken = errors.New("token is not provided")
+	// ErrTokenRevoked token was issued before password of its owner was changed
+	ErrTokenRevoked = errors.New("token is revoked")
+)
+
+// Claims identity of token owner. Moderator is the role at the time of issue, moderation actions check current role
+// of the account instead. Service token is issued to internal services, it has no user identity and grants read
+// access to all data. Version is token version of the account the token was issued with, token is revoked once
+// account's version is incremented
+type Claims struct {
+	UserID    int
+	Username  string
+	Moderator bool
+	Service   bool
+	Version   int
+}
+
+type tokenClaims struct {
+	Username  string `json:"username,omitempty"`
+	Moderator bool   `json:"mod,omitempty"`
+	Service   bool   `json:"svc,omitempty"`
+	Version   int    `json:"ver,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Signer issues and validates HMAC signed JWT session tokens
+type Signer struct {
+	key []byte
+	ttl time.Duration
+}
+
+func NewSigner(cfg config.AuthCfg) (*Signer, error) {
+	if len(cfg.SigningKey) < 32 {
+		return nil, errors.New("auth signing key must be at least 32 bytes long")
+	}
+	return &Signer{
+		key: []byte(cfg.SigningKey),
+		ttl: cfg.TokenTTL,
+	}, nil
+}
+
+func (s *Signer) Sign(claims Claims) (string, error) {
+	now := time.Now()
+	subject := strconv.Itoa(claims.UserID)
+	if claims.Service {
+		subject = serviceSubject
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		Username:  claims.Username,
+		Moderator: claims.Moderator,
+		Service:   claims.Service,
+		Version:   claims.Version,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.ttl)),
+		},
+	})
+	return token.SignedString(s.key)
+}
+
+// ServiceToken issues token for internal service calls
+func (s *Signer) ServiceToken() (string, error) {
+	return s.Sign(Claims{Service: true})
+}
+
+func (s *Signer) Parse(token string) (Claims, error) {
+	var parsed tokenClaims
+	_, err := jwt.ParseWithClaims(token, &parsed, func(*jwt.Token) (any, error) {
+		return s.key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if parsed.Service && parsed.Subject == serviceSubject {
+		return Claims{Service: true}, nil
+	}
+
+	userID, err := strconv.Atoi(parsed.Subject)
+	if err != nil || userID <= 0 {
+		return Claims{}, fmt.Errorf("invalid token subject: %q", parsed.Subject)
+	}
+
+	return Claims{UserID: userID, Username: parsed.Username, Moderator: parsed.Moderator, Version: parsed.Version}, nil
+}
+
+// CheckVersion reports ErrTokenRevoked if token version is older than current version of owner's account
+func (c Claims) CheckVersion(current int) error {
+	if !c.Service && c.Version < current {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// FromRequest extracts token from Authorization bearer header or token query parameter
+func FromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || token == "" {
+			return "", errors.New("malformed authorization header")
+		}
+		return token, nil
+	}
+
+	if token := r.URL.Query().Get(TokenQueryParam); token != "" {
+		return token, nil
+	}
+
+	return "", ErrNoToken
+}
@@ -0,0 +1,83 @@
+package kakafka
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/vlasashk/websocket-chat/config"
+)
+
+// headers of dead-lettered record describing why and where from it was moved, all of them share HeaderPrefix
+const (
+	HeaderPrefix    = "dlq-"
+	HeaderError     = HeaderPrefix + "error"
+	HeaderErrorKind = HeaderPrefix + "error-kind"
+	HeaderAttempts  = HeaderPrefix + "attempts"
+	HeaderTopic     = HeaderPrefix + "original-topic"
+	HeaderPartition = HeaderPrefix + "original-partition"
+	HeaderOffset    = HeaderPrefix + "original-offset"
+	HeaderFailedAt  = HeaderPrefix + "failed-at"
+)
+
+// syncBatchTimeout writer waits no longer for a batch to fill, synchronous writes come one by one
+const syncBatchTimeout = 10 * time.Millisecond
+
+// DeadLetter moves records which can't be processed to dead-letter topic. It writes synchronously
+// and waits for all in-sync replicas, so consumed record is committed only after it's safe in the dead-letter topic
+type DeadLetter struct {
+	writer *kafka.Writer
+}
+
+func NewDeadLetter(cfg config.KafkaCfg) *DeadLetter {
+	return &DeadLetter{
+		writer: NewSyncWriter(cfg.Addr, cfg.DeadLetterTopic),
+	}
+}
+
+// NewSyncWriter creates writer whose successful write is acknowledged by all in-sync replicas. Empty topic means
+// that each record names its own
+func NewSyncWriter(addr, topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(addr),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: syncBatchTimeout,
+	}
+}
+
+// Send writes copy of the record with its failure described by headers: error, its kind and number of attempts made
+func (d *DeadLetter) Send(ctx context.Context, msg kafka.Message, cause error, kind string, attempts int) error {
+	headers := append(make([]kafka.Header, 0, len(msg.Headers)+7), msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderErrorKind, Value: []byte(kind)},
+		kafka.Header{Key: HeaderAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+	return d.writer.WriteMessages(ctx, kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+}
+
+func (d *DeadLetter) Close() error {
+	return d.writer.Close()
+}
+
+// Header returns value of the record's header, the last one if it's repeated
+func Header(msg kafka.Message, key string) string {
+	var value string
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			value = string(h.Value)
+		}
+	}
+	return value
+}
@@ -0,0 +1,106 @@
+package kakafka
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/vlasashk/websocket-chat/config"
+)
+
+// ErrNotDrained consumer group didn't process records written to the topic before the wait began
+var ErrNotDrained = errors.New("consumer group has not caught up with the topic")
+
+// drainPoll how often committed offsets are checked while waiting for consumer group
+const drainPoll = 50 * time.Millisecond
+
+// Lag tracks progress of consumer group on its topic
+type Lag struct {
+	client *kafka.Client
+	topic  string
+	group  string
+}
+
+func NewLag(cfg config.KafkaCfg) *Lag {
+	return &Lag{
+		client: &kafka.Client{Addr: kafka.TCP(cfg.Addr)},
+		topic:  cfg.Topic,
+		group:  cfg.GroupID,
+	}
+}
+
+// WaitDrained waits until consumer group committed every record which was in the topic when the wait began.
+// ErrNotDrained is returned if it doesn't happen within timeout
+func (l *Lag) WaitDrained(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ends, err := l.endOffsets(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		committed, err := l.client.ConsumerOffsets(ctx, kafka.TopicAndGroup{Topic: l.topic, GroupId: l.group})
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err == nil && drained(ends, committed) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrNotDrained
+		case <-time.After(drainPoll):
+		}
+	}
+}
+
+// endOffsets returns offset of the next record to be written to each partition
+func (l *Lag) endOffsets(ctx context.Context) (map[int]int64, error) {
+	metadata, err := l.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{l.topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.Topics) == 0 {
+		return nil, errors.New("topic is missing in metadata")
+	}
+	if metadata.Topics[0].Error != nil {
+		return nil, metadata.Topics[0].Error
+	}
+
+	requests := make([]kafka.OffsetRequest, 0, len(metadata.Topics[0].Partitions))
+	for _, p := range metadata.Topics[0].Partitions {
+		requests = append(requests, kafka.LastOffsetOf(p.ID))
+	}
+	resp, err := l.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{l.topic: requests},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ends := make(map[int]int64)
+	for _, p := range resp.Topics[l.topic] {
+		if p.Error != nil {
+			return nil, p.Error
+		}
+		ends[p.Partition] = p.LastOffset
+	}
+	return ends, nil
+}
+
+// drained reports whether committed offset of each partition reached its end. Partition without commits (reported
+// as missing or negative offset) is drained only if nothing was written to it
+func drained(ends, committed map[int]int64) bool {
+	for partition, end := range ends {
+		if end <= 0 {
+			continue
+		}
+		if committed[partition] < end {
+			return false
+		}
+	}
+	return true
+}
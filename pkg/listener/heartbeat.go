@@ -0,0 +1,68 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/vlasashk/websocket-chat/config"
+)
+
+// Close codes and reasons reported to peer when connection is terminated due to timeout
+const (
+	KeepaliveCloseCode   = websocket.CloseGoingAway
+	KeepaliveCloseReason = "keepalive timeout"
+	IdleCloseCode        = websocket.CloseNormalClosure
+	IdleCloseReason      = "idle timeout"
+
+	closeWriteWait = time.Second
+)
+
+// ExpectPongs sets read deadline of connection and extends it on every pong, so peer that doesn't answer pings
+// within PongWait fails pending read with timeout error. Pong handler is invoked only while connection is being read.
+// It must be called before connection is read, since only one goroutine may use the read side of connection
+func ExpectPongs(con *websocket.Conn, cfg config.HeartbeatCfg) error {
+	if err := con.SetReadDeadline(time.Now().Add(cfg.PongWait)); err != nil {
+		return err
+	}
+	con.SetPongHandler(func(string) error {
+		return con.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	})
+	return nil
+}
+
+// Heartbeat pings peer with PingInterval until ctx is done. It only writes control frames, so it runs alongside
+// SocketListen, ExpectPongs must be called before both of them
+func Heartbeat(ctx context.Context, log zerolog.Logger, con *websocket.Conn, cfg config.HeartbeatCfg) error {
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := con.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.WriteWait)); err != nil {
+				log.Debug().Err(err).Msg("failed to send ping")
+				return err
+			}
+		}
+	}
+}
+
+// IsTimeout reports whether err is caused by exceeded read or write deadline
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// SendClose notifies peer with close code and reason. Connection itself is closed by its owner
+func SendClose(log zerolog.Logger, con *websocket.Conn, code int, reason string) {
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	if err := con.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(closeWriteWait)); err != nil {
+		log.Debug().Err(err).Msg("failed to send close message")
+	}
+}
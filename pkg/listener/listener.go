@@ -8,7 +8,8 @@ import (
 )
 
 // SocketListen Separate goroutine to listen WS connection, exposing channel for received data
-// (was required to be able to release connection when gracefully shut down, since ReadMessage() is blocking)
+// (was required to be able to release connection when gracefully shut down, since ReadMessage() is blocking).
+// Peer is notified with close frame when read deadline set by Heartbeat is exceeded
 func SocketListen(ctx context.Context, log zerolog.Logger, con *websocket.Conn) <-chan []byte {
 	listen := make(chan []byte)
 	go func() {
@@ -20,12 +21,19 @@ func SocketListen(ctx context.Context, log zerolog.Logger, con *websocket.Conn)
 				mt, message, err := con.ReadMessage()
 				if err != nil || mt == websocket.CloseMessage {
 					close(listen)
+					if IsTimeout(err) {
+						SendClose(log, con, KeepaliveCloseCode, KeepaliveCloseReason)
+					}
 					if err != nil {
 						log.Error().Err(err).Send()
 					}
 					return
 				}
-				listen <- message
+				select {
+				case listen <- message:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -0,0 +1,239 @@
+package response
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion current version of WS envelope protocol
+const ProtocolVersion = 1
+
+type EnvelopeType string
+
+const (
+	// TypeHello first frame sent by server to tell client its identity
+	TypeHello EnvelopeType = "hello"
+	// TypeMessage chat message
+	TypeMessage EnvelopeType = "message"
+	// TypeError structured error in response to client's frame
+	TypeError EnvelopeType = "error"
+	// TypeAck confirmation of successfully processed client's frame
+	TypeAck EnvelopeType = "ack"
+	// TypeSystem informational server notice
+	TypeSystem EnvelopeType = "system"
+	// TypeHistory batch of previously sent messages, also request for page of older messages
+	TypeHistory EnvelopeType = "history"
+	// TypePresence user joined or left the room
+	TypePresence EnvelopeType = "presence"
+	// TypeRoster request for users present in current room, answered with the list of users
+	TypeRoster EnvelopeType = "roster"
+	// TypeJoin request to switch connection to another room
+	TypeJoin EnvelopeType = "join"
+	// TypeDirect private message delivered only to connections of sender and recipient
+	TypeDirect EnvelopeType = "direct"
+	// TypeEdit request to edit own message, broadcast back with edited message
+	TypeEdit EnvelopeType = "edit"
+	// TypeDelete request to delete message, broadcast back so clients hide it
+	TypeDelete EnvelopeType = "delete"
+	// TypeReaction request to add or remove reaction, broadcast back with updated count
+	TypeReaction EnvelopeType = "reaction"
+	// TypeTyping ephemeral typing indicator, it's not acknowledged and never stored
+	TypeTyping EnvelopeType = "typing"
+	// TypeReceipt delivery or read acknowledgement of room message, broadcast back to the room
+	TypeReceipt EnvelopeType = "receipt"
+	// TypeReadBy request for users who have read the message, answered with the list of users
+	TypeReadBy EnvelopeType = "read_by"
+	// TypeSearch full-text search request over messages visible to the user, answered with results
+	TypeSearch EnvelopeType = "search"
+)
+
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnsupportedType    = "unsupported_type"
+	ErrCodeInternal           = "internal"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeMuted              = "muted"
+)
+
+// Envelope single frame of WS protocol. ID correlates client's request with server's ack or error
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    EnvelopeType    `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type HelloPayload struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type SystemPayload struct {
+	Text string `json:"text"`
+}
+
+// HistoryPayload LastRead and Unread tell read position of the user in the room on join,
+// Before is set in answer to history request. Resumed pages replay messages missed since resume point of reconnected
+// session, Truncated tells that there were more missed messages than replayed ones
+type HistoryPayload struct {
+	Room      string `json:"room"`
+	Messages  []Msg  `json:"messages"`
+	Before    string `json:"before,omitempty"`
+	LastRead  string `json:"last_read,omitempty"`
+	Unread    int    `json:"unread,omitempty"`
+	Resumed   bool   `json:"resumed,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// HistoryRequest asks for up to Limit messages of current room sent before message with ID Before,
+// the latest messages are returned if Before is empty
+type HistoryRequest struct {
+	Before string `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type JoinPayload struct {
+	Room string `json:"room"`
+}
+
+type EditPayload struct {
+	MessageID string `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+// DeletePayload DeletedBy is set by server, it differs from message author on moderator takedown
+type DeletePayload struct {
+	MessageID string `json:"message_id"`
+	DeletedBy int    `json:"deleted_by,omitempty"`
+}
+
+// ReactionPayload UserID, Username and Count are set by server
+type ReactionPayload struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove,omitempty"`
+	UserID    int    `json:"user_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Count     int    `json:"count"`
+}
+
+// TypingPayload UserID, Username and Room are set by server
+type TypingPayload struct {
+	Typing   bool   `json:"typing"`
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Room     string `json:"room,omitempty"`
+}
+
+// ReceiptPayload Kind is ReceiptDelivered or ReceiptRead. UserID, Username and Room are set by server
+type ReceiptPayload struct {
+	MessageID string `json:"message_id"`
+	Kind      string `json:"kind"`
+	UserID    int    `json:"user_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Room      string `json:"room,omitempty"`
+}
+
+type ReadByPayload struct {
+	MessageID string       `json:"message_id"`
+	Users     []ReadMarker `json:"users"`
+}
+
+// SearchRequest asks for up to Limit messages matching Query skipping Offset the most relevant ones
+type SearchRequest struct {
+	Query  string `json:"query"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// SearchPayload NextOffset is passed as offset to get the next page, it's omitted on the last page
+type SearchPayload struct {
+	Query      string      `json:"query"`
+	Results    []SearchHit `json:"results"`
+	NextOffset int         `json:"next_offset,omitempty"`
+}
+
+const (
+	PresenceJoined = "joined"
+	PresenceLeft   = "left"
+)
+
+// PresencePayload is sent when first connection of user joins the room or the last one leaves it
+type PresencePayload struct {
+	Action   string `json:"action"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Room     string `json:"room"`
+}
+
+// NewPresence builds broadcast of presence change in the room, connections of the user itself are skipped
+func NewPresence(action, room string, user Member) (Broadcast, error) {
+	env, err := NewEnvelope(TypePresence, "", PresencePayload{
+		Action:   action,
+		UserID:   user.UserID,
+		Username: user.Username,
+		Room:     room,
+	})
+	if err != nil {
+		return Broadcast{}, err
+	}
+	return Broadcast{Room: room, ExcludeUserID: user.UserID, Envelope: env}, nil
+}
+
+type RosterPayload struct {
+	Room  string   `json:"room"`
+	Users []Member `json:"users"`
+}
+
+// Broadcast frame addressed to room members, or to connections of sender and recipient if RecipientID is set.
+// Connections of ExcludeUserID are skipped in room broadcast
+type Broadcast struct {
+	Room          string   `json:"room,omitempty"`
+	UserID        int      `json:"user_id,omitempty"`
+	RecipientID   int      `json:"recipient_id,omitempty"`
+	ExcludeUserID int      `json:"exclude_user_id,omitempty"`
+	Envelope      Envelope `json:"envelope"`
+}
+
+// NewEnvelope wraps payload into envelope of current protocol version
+func NewEnvelope(t EnvelopeType, id string, payload any) (Envelope, error) {
+	env := Envelope{
+		Version: ProtocolVersion,
+		Type:    t,
+		ID:      id,
+	}
+	if payload == nil {
+		return env, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env.Payload = data
+
+	return env, nil
+}
+
+// NewError builds error envelope correlated with request id
+func NewError(id, code, message string) Envelope {
+	// ErrorPayload always marshals successfully
+	env, _ := NewEnvelope(TypeError, id, ErrorPayload{Code: code, Message: message})
+	return env
+}
+
+// Decode unmarshals envelope payload into v
+func (e Envelope) Decode(v any) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("empty payload for %q envelope", e.Type)
+	}
+	return json.Unmarshal(e.Payload, v)
+}
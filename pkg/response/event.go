@@ -0,0 +1,75 @@
+package response
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type EventType string
+
+const (
+	// EventMessage new chat message
+	EventMessage EventType = "message"
+	// EventEdit new revision of message text
+	EventEdit EventType = "edit"
+	// EventDelete removal of message by its author or moderator
+	EventDelete EventType = "delete"
+	// EventReaction reaction added to or removed from message
+	EventReaction EventType = "reaction"
+	// EventReceipt delivery or read position of user in the room
+	EventReceipt EventType = "receipt"
+)
+
+// Event record passed from server to storage service via kafka. Records without event type are plain messages
+// written before events were introduced
+type Event struct {
+	Type    EventType       `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type MessageEdit struct {
+	MessageID string    `json:"message_id"`
+	UserID    int       `json:"user_id"`
+	Text      string    `json:"text"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// MessageDelete UserID is the one who deletes message, it's not necessarily author if Moderator is set. Storage
+// service checks the role itself rather than trusting Moderator
+type MessageDelete struct {
+	MessageID string    `json:"message_id"`
+	UserID    int       `json:"user_id"`
+	Moderator bool      `json:"moderator,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type MessageReaction struct {
+	MessageID string    `json:"message_id"`
+	UserID    int       `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	Remove    bool      `json:"remove,omitempty"`
+	ReactedAt time.Time `json:"reacted_at"`
+}
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Receipt Kind is either ReceiptDelivered or ReceiptRead, read message is delivered as well
+type Receipt struct {
+	UserID    int       `json:"user_id"`
+	Room      string    `json:"room"`
+	MessageID string    `json:"message_id"`
+	Kind      string    `json:"kind"`
+	At        time.Time `json:"at"`
+}
+
+// NewEvent marshals payload into event record
+func NewEvent(t EventType, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Event{Type: t, Payload: data})
+}
@@ -2,22 +2,159 @@ package response
 
 import (
 	"fmt"
+	"sort"
+	"time"
 )
 
+const refLen = 8
+
+// Msg chat message. ID and SentAt are assigned by server and are authoritative for cache, broker and database.
+// Seq orders messages of the room the same way in broadcast, cache and database.
+// IdempotencyKey is chosen by client to resend message safely, message ID is used if it's empty.
+// Direct message has recipient instead of room and no sequence number
 type Msg struct {
-	UserID   int    `json:"user_id,omitempty"`
-	Username string `json:"username"`
-	Text     string `json:"text"`
+	ID             string    `json:"message_id,omitempty"`
+	Seq            int64     `json:"seq,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	UserID         int       `json:"user_id,omitempty"`
+	Username       string    `json:"username"`
+	Room           string    `json:"room"`
+	RecipientID    int       `json:"recipient_id,omitempty"`
+	Recipient      string    `json:"recipient,omitempty"`
+	Text           string    `json:"text"`
+	SentAt         time.Time `json:"sent_at"`
+	// EditedAt time of the last edit, nil if message was never edited
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Reactions counts by emoji, filled in history only
+	Reactions map[string]int `json:"reactions,omitempty"`
 }
 
 type RegisterReq struct {
 	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type RegisterResp struct {
 	UserID int `json:"user_id"`
 }
 
+type User struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Moderator bool      `json:"moderator,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// TokenVersion session tokens issued with older version are revoked
+	TokenVersion int `json:"token_version"`
+}
+
+// Member user present in the room
+type Member struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// OnlineUser connected user with rooms of its connections
+type OnlineUser struct {
+	UserID      int      `json:"user_id"`
+	Username    string   `json:"username"`
+	Rooms       []string `json:"rooms"`
+	Connections int      `json:"connections"`
+}
+
+// RoomInfo stored state of the room, LastSeq is sequence number of the latest stored message
+type RoomInfo struct {
+	Room    string `json:"room"`
+	LastSeq int64  `json:"last_seq"`
+}
+
+// MessagePage page of messages, NextCursor is passed as cursor to get the next page. It's omitted on the last page
+type MessagePage struct {
+	Messages   []Msg  `json:"messages"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SearchHit message matching search query. Highlight is fragment of message text with matched terms wrapped into ** markers
+type SearchHit struct {
+	Msg
+	Rank      float32 `json:"rank"`
+	Highlight string  `json:"highlight"`
+}
+
+// SearchPage page of search results, NextOffset is passed as offset to get the next page. It's omitted on the last page
+type SearchPage struct {
+	Results    []SearchHit `json:"results"`
+	NextOffset int         `json:"next_offset,omitempty"`
+}
+
+// ReadState position of user in the room, Unread counts messages of other users after LastRead
+type ReadState struct {
+	Room          string `json:"room"`
+	LastDelivered string `json:"last_delivered,omitempty"`
+	LastRead      string `json:"last_read,omitempty"`
+	Unread        int    `json:"unread"`
+}
+
+// ReadMarker user who has read the room up to LastRead message
+type ReadMarker struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	LastRead string    `json:"last_read"`
+	ReadAt   time.Time `json:"read_at"`
+}
+
+type LoginReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordReq struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ClaimReq first password of account created before passwords were introduced
+type ClaimReq struct {
+	Password string `json:"password"`
+}
+
+type LoginResp struct {
+	UserID int    `json:"user_id"`
+	Token  string `json:"token"`
+}
+
 func (m Msg) Print() {
-	fmt.Printf("<%s>:%s\n", m.Username, m.Text)
+	var suffix string
+	if m.EditedAt != nil {
+		suffix = " (edited)"
+	}
+	emojis := make([]string, 0, len(m.Reactions))
+	for emoji := range m.Reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+	for _, emoji := range emojis {
+		suffix += fmt.Sprintf(" %s%d", emoji, m.Reactions[emoji])
+	}
+
+	if m.RecipientID != 0 {
+		fmt.Printf("[dm] %s #%s <%s -> %s>:%s%s\n", m.SentAt.Local().Format(time.TimeOnly), m.Ref(), m.Username, m.Recipient, m.Text, suffix)
+		return
+	}
+	fmt.Printf("[%s] %s #%s <%s>:%s%s\n", m.Room, m.SentAt.Local().Format(time.TimeOnly), m.Ref(), m.Username, m.Text, suffix)
+}
+
+// Ref short reference of message used to address it in client commands (random tail of time-ordered ID)
+func (m Msg) Ref() string {
+	if len(m.ID) <= refLen {
+		return m.ID
+	}
+	return m.ID[len(m.ID)-refLen:]
+}
+
+// Claim of message idempotency key: ID of the message it was taken for and whether the message was stored. Claim stays
+// pending if server failed while storing the message
+type Claim struct {
+	MessageID string
+	Committed bool
 }
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// CanonicalUsername NFKC normalized form of username stored and displayed for the account
+func CanonicalUsername(name string) string {
+	return norm.NFKC.String(strings.TrimSpace(name))
+}
+
+// UsernameKey case-insensitive key used to match usernames, so "Bob", "BOB" and "Ｂｏｂ" resolve to the same account
+func UsernameKey(name string) string {
+	return cases.Fold().String(CanonicalUsername(name))
+}